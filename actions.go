@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	errUnknownAction  = errors.New("unknown action")
+	errExtRequired    = errors.New("extension required")
+	errNotMonitored   = errors.New("not monitored")
+	errServiceStopped = errors.New("service is not running")
+)
+
+// adminActions содержит список поддерживаемых административных действий.
+// Для всех действий, кроме resync, необходимо указать внутренний номер
+// пользователя.
+var adminActions = map[string]bool{
+	"disconnect":   true, // отключить клиентов SSE пользователя
+	"monitor-stop": true, // остановить монитор и отключить его клиентов
+	"revoke":       true, // отозвать токены и закрыть сессию пользователя
+	"logout":       true, // отозвать токены и остановить монитор
+	"resync":       true, // заново загрузить адресную книгу с сервера MX
+}
+
+// action выполняет административное действие и возвращает описание его
+// результата.
+func (a *Admin) action(r *http.Request, action, ext string) (string, error) {
+	if !adminActions[action] {
+		return "", errUnknownAction
+	}
+	if ext == "" && action != "resync" {
+		return "", errExtRequired
+	}
+	a.mu.RLock()
+	var handler *HTTPHandler
+	if a.proxy != nil {
+		handler = a.proxy.handler
+	}
+	a.mu.RUnlock()
+	if handler == nil {
+		return "", errServiceStopped
+	}
+	var mxs = handler.mx()
+	var result string
+	switch action {
+	case "disconnect":
+		var md = mxs.monitor(ext)
+		if md == nil {
+			return "", errNotMonitored
+		}
+		result = fmt.Sprintf("%s: %d clients disconnected", ext, md.disconnect())
+	case "monitor-stop":
+		if mxs.monitor(ext) == nil {
+			return "", errNotMonitored
+		}
+		if err := mxs.MonitorStop(ext); err != nil {
+			return "", err
+		}
+		result = ext + ": monitor stopped"
+	case "revoke", "logout":
+		revokeTokens(ext)
+		if err := handler.sessionStop(ext); err != nil {
+			a.log.Error("mx session stop error", "ext", ext, err)
+		}
+		result = ext + ": tokens revoked"
+		if action == "logout" {
+			stopped, err := mxs.MonitorLogout(ext)
+			if err != nil {
+				return "", err
+			}
+			if stopped {
+				result += ", monitor stopped"
+			}
+		}
+	case "resync":
+		count, err := mxs.ResyncAddressbook()
+		if err != nil {
+			return "", err
+		}
+		result = fmt.Sprintf("%d contacts loaded", count)
+	}
+	securityLog.Info("admin action", "action", action, "ext", ext,
+		"by", adminLogin(r))
+	a.audit(r, "actions", "", action+": "+result)
+	return result, nil
+}
+
+// actionStatus возвращает статус HTTP-ответа для ошибки выполнения
+// административного действия.
+func actionStatus(err error) int {
+	switch err {
+	case errUnknownAction, errExtRequired:
+		return http.StatusBadRequest
+	case errNotMonitored:
+		return http.StatusNotFound
+	case errServiceStopped:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway // ошибка сервера MX
+}
+
+// Actions выполняет административные действия со страницы мониторинга:
+// отключение клиентов и остановку монитора пользователя, отзыв его токенов
+// и повторную загрузку адресной книги.
+func (a *Admin) Actions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		status := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ext = strings.TrimSpace(r.PostForm.Get("ext"))
+	result, err := a.action(r, r.PostForm.Get("action"), ext)
+	if err != nil {
+		http.Error(w, err.Error(), actionStatus(err))
+		return
+	}
+	http.Redirect(w, r, "/dashboard?"+url.Values{"message": {result}}.Encode(),
+		http.StatusFound)
+}
+
+// apiAction выполняет административное действие, переданное в виде объекта
+// JSON с названием действия и внутренним номером пользователя.
+func (a *Admin) apiAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		a.apiMethodNotAllowed(w, "POST")
+		return
+	}
+	var params struct {
+		Action string `json:"action"`
+		Ext    string `json:"ext"`
+	}
+	if err := readJSON(w, r, &params); err != nil {
+		a.apiError(w, http.StatusBadRequest, "bad json: "+err.Error())
+		return
+	}
+	result, err := a.action(r, params.Action, strings.TrimSpace(params.Ext))
+	if err != nil {
+		a.apiError(w, actionStatus(err), err.Error())
+		return
+	}
+	a.apiWrite(w, http.StatusOK, map[string]string{"result": result})
+}
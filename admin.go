@@ -3,28 +3,37 @@ package main
 import (
 	"archive/zip"
 	"bytes"
-	"fmt"
+	"errors"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/mdigger/log"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/mdigger/sse"
 )
 
 // Admin описывает административный сервер.
 type Admin struct {
-	config *Config            // конфигурация сервиса
-	tmpl   *template.Template // шаблон административного сайта
-	proxy  *Proxy             // веб сервер
-	mu     sync.RWMutex       // блокировка одновременного доступа к конфигурации
-	log    *log.Logger        // для вывода лога
+	config     *Config            // конфигурация сервиса
+	tmpl       *template.Template // шаблон административного сайта
+	proxy      *Proxy             // веб сервер
+	auditLog   *AuditLog          // журнал изменений конфигурации
+	sessions   AdminSessions      // сессии администраторов
+	limiter    *LoginLimiter      // ограничение неудачных попыток авторизации
+	setupToken string             // токен для первоначальной настройки
+	events     *sse.Server        // события страницы мониторинга
+	mu         sync.RWMutex       // блокировка одновременного доступа к конфигурации
+	log        *log.Logger        // для вывода лога
 }
 
 // Config отвечает за изменение и отображение конфигурационного файла.
+// Новые значения проверяются до сохранения: при изменении параметров
+// подключения к серверу MX или адреса сервера проверяется подключение, а при
+// ошибке конфигурация не изменяется и ошибка отображается в форме.
 func (a *Admin) Config(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
@@ -32,117 +41,46 @@ func (a *Admin) Config(w http.ResponseWriter, r *http.Request) {
 	}
 	switch r.Method {
 	case "GET": // отдаем страничку с административным интерфейсом
-		var buf bytes.Buffer
-		a.config.mu.RLock()
-		err := a.tmpl.Execute(&buf, a.config)
-		a.config.mu.RUnlock()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			a.log.Error("template error", err)
-			return
-		}
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		if _, err = buf.WriteTo(w); err != nil {
-			a.log.Error("http response error", err)
-		}
+		a.configPage(w, r, http.StatusOK, nil, "")
 	case "POST":
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		var changed, mxChanged, serverChanged bool
-		a.config.mu.Lock()
-		for name, values := range r.PostForm {
-			if len(values) == 0 {
-				continue
-			}
-			value := strings.TrimSpace(values[0])
-			if value == "" {
-				continue
-			}
-			switch name {
-			case "admin.login":
-				if value == a.config.Admin.Login {
-					continue
-				}
-				a.config.Admin.Login = value
-			case "admin.password":
-				if bcrypt.CompareHashAndPassword(
-					a.config.Admin.Password, []byte(value)) == nil {
+		var test = r.PostForm.Get("action") == "test"
+		config, errs, err := a.changeConfig(r, test, func(config *Config) []string {
+			var errs []string
+			for name, values := range r.PostForm {
+				if len(values) == 0 {
 					continue
 				}
-				password, err := bcrypt.GenerateFromPassword(
-					[]byte(value), bcrypt.DefaultCost)
-				if err != nil {
-					a.log.Error("bcrypt password error", err)
+				value := strings.TrimSpace(values[0])
+				if value == "" && name != "roles.users" && name != "roles.groups" {
 					continue
 				}
-				a.config.Admin.Password = password
-			case "server.host":
-				if value == a.config.Server.Host {
+				// переопределенные значения изменить нельзя
+				if config.Overridden(name) {
 					continue
 				}
-				a.config.Server.Host = value
-				serverChanged = true
-			case "server.log":
-				switch value {
-				case "ALL":
-					log.SetLevel(log.TRACE)
-					a.config.Server.LogLevel = -1
-				case "INFO":
-					log.SetLevel(log.INFO)
-					a.config.Server.LogLevel = 0
-				case "ERROR":
-					log.SetLevel(log.WARN)
-					a.config.Server.LogLevel = 1
-				default:
-					continue
-				}
-			case "mx.host":
-				if value == a.config.MX.Host {
-					continue
+				_, err := config.setField(name, value)
+				if err != nil && err != errUnknownField {
+					errs = append(errs, err.Error())
 				}
-				a.config.MX.Host = value
-				mxChanged = true
-			case "mx.login":
-				if value == a.config.MX.Login {
-					continue
-				}
-				a.config.MX.Login = value
-				mxChanged = true
-			case "mx.password":
-				if value == string(a.config.MX.Password) {
-					continue
-				}
-				a.config.MX.Password = []byte(value)
-				mxChanged = true
-			default:
-				if !strings.HasPrefix(name, "params.") {
-					continue
-				}
-				a.config.Params[strings.TrimPrefix(name, "params.")] = value
 			}
-			changed = true
+			return errs
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		a.config.mu.Unlock()
-		if changed {
-			if err := a.config.Save(); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				a.log.Error("config save error", err)
-				return
-			}
-			a.log.Info("config changed")
+		if len(errs) > 0 {
+			a.configPage(w, r, http.StatusBadRequest, config,
+				strings.Join(errs, "; "))
+			return
 		}
-		if serverChanged || mxChanged {
-			a.mu.Lock()
-			if a.proxy != nil {
-				a.proxy.Close()
-			}
-			proxy, err := NewProxy(a.config)
-			a.config.mu.Lock()
-			a.proxy, a.config.err = proxy, err
-			a.config.mu.Unlock()
-			a.mu.Unlock()
+		if test {
+			a.configPage(w, r, http.StatusOK, config, "Connection OK.")
+			return
 		}
 		// после изменения конфигурации перенаправляем на начальную страницу,
 		// чтобы сбросить кеш браузера
@@ -154,39 +92,139 @@ func (a *Admin) Config(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func badAuthorization(w http.ResponseWriter) {
-	w.Header().Set("WWW-Authenticate",
-		fmt.Sprintf("Basic realm=\"%s Admin\"", appName))
-	status := http.StatusUnauthorized
-	http.Error(w, http.StatusText(status), status)
-}
-
-// Authorization проверяет авторизацию. Возвращает ошибку, если авторизация
-// не прошла.
-func (a *Admin) Authorization(h http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		login, password, ok := r.BasicAuth()
-		if !ok {
-			badAuthorization(w)
-			a.log.Error("no authorized request")
-			return
+// changeConfig применяет изменения к копии конфигурации и проверяет их: при
+// изменении параметров подключения к серверу MX или адреса сервера
+// проверяется подключение, а при явной проверке (test) подключение
+// проверяется всегда, но изменения не сохраняются. Если ошибок нет, то
+// изменения сохраняются, записываются в журнал и перезапускают только
+// изменившиеся части сервиса. Возвращает проверенную копию конфигурации и
+// список ошибок проверки.
+//
+// Проверка подключения выполняется без блокировки конфигурации, поэтому
+// после нее изменения применяются повторно к текущей конфигурации: так
+// сохраняются изменения, сделанные параллельно другими администраторами или
+// перезагрузкой файла. Если за время проверки изменились параметры
+// подключения, то проверка повторяется.
+func (a *Admin) changeConfig(r *http.Request, test bool,
+	change func(config *Config) []string) (*Config, []string, error) {
+	for attempt := 0; ; attempt++ {
+		a.config.mu.RLock()
+		var state = a.config.state()
+		var config = a.config.clone()
+		a.config.mu.RUnlock()
+		var errs = change(config)
+		sort.Strings(errs)
+		if len(errs) == 0 {
+			var old = state
+			if test {
+				old = configState{}
+			}
+			if err := a.checkConnection(old, config.state()); err != nil {
+				errs = append(errs, err.Error())
+			}
 		}
-		a.mu.RLock()
-		if login != a.config.Admin.Login {
-			a.mu.RUnlock()
-			badAuthorization(w)
-			a.log.Error("bad authorization request", "login", login)
-			return
+		if len(errs) > 0 || test {
+			return config, errs, nil
 		}
-		if err := bcrypt.CompareHashAndPassword(
-			a.config.Admin.Password, []byte(password)); err != nil {
-			a.mu.RUnlock()
-			badAuthorization(w)
-			a.log.Error("bad authorization password")
-			return
+		a.config.mu.Lock()
+		if a.config.state() == state {
+			// применяем изменения к текущей конфигурации
+			var checked = config.state()
+			config = a.config.clone()
+			errs = change(config)
+			sort.Strings(errs)
+			if len(errs) > 0 {
+				a.config.mu.Unlock()
+				return config, errs, nil
+			}
+			if config.state() == checked {
+				return a.commitConfig(r, config)
+			}
 		}
-		a.mu.RUnlock()
-		h.ServeHTTP(w, r) // обрабатываем запрос после авторизации
+		a.config.mu.Unlock()
+		if attempt == 2 {
+			return config, nil, errors.New("config changed concurrently, try again")
+		}
+	}
+}
+
+// commitConfig заменяет значения конфигурации проверенными, сохраняет их,
+// записывает изменения в журнал и перезапускает изменившиеся части сервиса.
+// Должна вызываться с блокировкой конфигурации на запись, которая
+// освобождается.
+func (a *Admin) commitConfig(r *http.Request, config *Config) (*Config, []string, error) {
+	// для перезапуска изменившихся частей и журнала изменений
+	var state = a.config.state()
+	var changes = a.config.diff(config)
+	a.config.Server = config.Server
+	a.config.MX = config.MX
+	a.config.Roles = config.Roles
+	a.config.Params = config.Params
+	a.config.GroupParams = config.GroupParams
+	a.config.ExtParams = config.ExtParams
+	a.config.mu.Unlock()
+	if len(changes) == 0 {
+		return config, nil, nil
+	}
+	if err := a.config.Save(); err != nil {
+		a.log.Error("config save error", err)
+		return config, nil, err
+	}
+	for _, change := range changes {
+		a.audit(r, change[0], change[1], change[2])
+	}
+	a.apply(state)
+	return config, nil, nil
+}
+
+// configPage отдает страницу административного интерфейса. Если передана
+// проверяемая конфигурация, то в форме отображаются ее значения вместе с
+// сообщением о результате проверки.
+func (a *Admin) configPage(w http.ResponseWriter, r *http.Request, status int,
+	config *Config, message string) {
+	var buf bytes.Buffer
+	var csrf string
+	if session := adminSessionFrom(r); session != nil {
+		csrf = session.CSRF
+	}
+	// счетчики ограничений запросов к API и звонков
+	var rateStats, callStats []*RateStat
+	a.mu.RLock()
+	if a.proxy != nil {
+		rateStats = a.proxy.handler.rateLimiter.Stats()
+		callStats = a.proxy.handler.callQuota.Stats()
+	}
+	a.mu.RUnlock()
+	a.config.mu.RLock()
+	if config == nil {
+		config = a.config
+	}
+	err := a.tmpl.Execute(&buf, &struct {
+		*Config
+		CSRF      string      // токен для защиты форм от CSRF
+		Login     string      // логин авторизованного администратора
+		Message   string      // результат проверки изменений
+		RateStats []*RateStat // счетчики запросов к API
+		CallStats []*RateStat // счетчики звонков
+	}{
+		Config:    config,
+		CSRF:      csrf,
+		Login:     adminLogin(r),
+		Message:   message,
+		RateStats: rateStats,
+		CallStats: callStats,
+	})
+	a.config.mu.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		a.log.Error("template error", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if _, err = buf.WriteTo(w); err != nil {
+		a.log.Error("http response error", err)
 	}
 }
 
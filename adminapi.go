@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminAPIPrefix задает префикс адресов JSON API административного сервера.
+const adminAPIPrefix = "/api/admin/"
+
+// started содержит время запуска сервиса.
+var started = time.Now()
+
+// writeJSON отдает данные в формате JSON с указанным статусом.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// apiError отдает описание ошибки в формате JSON.
+func (a *Admin) apiError(w http.ResponseWriter, status int, message string) {
+	if err := writeJSON(w, status, map[string]string{"error": message}); err != nil {
+		a.log.Error("http response error", err)
+	}
+}
+
+// apiWrite отдает ответ JSON API и выводит в лог ошибку отправки.
+func (a *Admin) apiWrite(w http.ResponseWriter, status int, v interface{}) {
+	if err := writeJSON(w, status, v); err != nil {
+		a.log.Error("http response error", err)
+	}
+}
+
+// readJSON разбирает тело запроса в формате JSON.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	return dec.Decode(v)
+}
+
+// jsonString возвращает строковое представление значения из JSON: строки
+// возвращаются без изменения, а числа и логические значения преобразуются
+// в строку.
+func jsonString(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// API обрабатывает запросы к JSON API административного сервера.
+func (a *Admin) API(w http.ResponseWriter, r *http.Request) {
+	var path = strings.TrimPrefix(r.URL.Path, adminAPIPrefix)
+	switch {
+	case path == "config":
+		a.apiConfig(w, r)
+	case path == "status":
+		a.apiStatus(w, r)
+	case path == "actions":
+		a.apiAction(w, r)
+	case path == "params" || strings.HasPrefix(path, "params/"):
+		// область действия параметров: глобальные, группы или номера
+		var scope = r.URL.Query().Get("scope")
+		a.config.mu.RLock()
+		var _, err = a.config.paramsScope(scope, false)
+		a.config.mu.RUnlock()
+		if err != nil {
+			a.apiError(w, http.StatusBadRequest, err.Error())
+		} else if path == "params" {
+			a.apiParams(w, r, scope)
+		} else if key := strings.TrimPrefix(path, "params/"); key != "" {
+			a.apiParam(w, r, scope, key)
+		} else {
+			a.apiError(w, http.StatusNotFound, "not found")
+		}
+	default:
+		a.apiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// apiMethodNotAllowed отдает ошибку неподдерживаемого метода запроса.
+func (a *Admin) apiMethodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	status := http.StatusMethodNotAllowed
+	a.apiError(w, status, http.StatusText(status))
+}
+
+// configJSON возвращает значения полей конфигурации для JSON API и список
+// переопределенных полей. Секретные значения не отдаются. Должна вызываться
+// с блокировкой конфигурации.
+func (c *Config) configJSON() map[string]interface{} {
+	var fields = make(map[string]string, len(configFields))
+	var overridden = make([]string, 0)
+	for _, name := range configFields {
+		fields[name] = c.field(name)
+		if c.Overridden(name) {
+			overridden = append(overridden, name)
+		}
+	}
+	if fields["mx.password"] != "" {
+		fields["mx.password"] = secretMask
+	}
+	return map[string]interface{}{
+		"config":     fields,
+		"overridden": overridden,
+	}
+}
+
+// apiConfig отдает и изменяет поля конфигурации. Изменения передаются в
+// виде объекта JSON с именами полей и проходят те же проверки, что и
+// изменения через форму. Параметр запроса test позволяет только проверить
+// изменения без сохранения.
+func (a *Admin) apiConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		a.config.mu.RLock()
+		var result = a.config.configJSON()
+		a.config.mu.RUnlock()
+		a.apiWrite(w, http.StatusOK, result)
+	case "PATCH":
+		var values map[string]interface{}
+		if err := readJSON(w, r, &values); err != nil {
+			a.apiError(w, http.StatusBadRequest, "bad json: "+err.Error())
+			return
+		}
+		var test, _ = strconv.ParseBool(r.URL.Query().Get("test"))
+		config, errs, err := a.changeConfig(r, test, func(config *Config) []string {
+			var errs []string
+			for name, value := range values {
+				text, ok := jsonString(value)
+				switch {
+				case !ok:
+					errs = append(errs, "bad "+name+" value")
+				case strings.HasPrefix(name, "params."):
+					errs = append(errs, name+": use "+adminAPIPrefix+"params")
+				case checkField(name, text) == errUnknownField:
+					errs = append(errs, "unknown config field: "+name)
+				case config.Overridden(name):
+					errs = append(errs, name+" is overridden")
+				case name == "mx.password" && text == secretMask:
+					// значение не изменилось
+				default:
+					if _, err := config.setField(name, strings.TrimSpace(text)); err != nil {
+						errs = append(errs, err.Error())
+					}
+				}
+			}
+			return errs
+		})
+		if err != nil {
+			a.apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(errs) > 0 {
+			a.apiError(w, http.StatusBadRequest, strings.Join(errs, "; "))
+			return
+		}
+		a.apiWrite(w, http.StatusOK, config.configJSON())
+	default:
+		a.apiMethodNotAllowed(w, "GET, PATCH")
+	}
+}
+
+// apiStatus отдает состояние сервиса: версию, время работы, состояние
+// соединения с сервером MX и запущенные мониторы.
+func (a *Admin) apiStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		a.apiMethodNotAllowed(w, "GET")
+		return
+	}
+	var mx = new(MXStatus) // сервис не запущен
+	var monitoring map[string]int
+	a.mu.RLock()
+	if a.proxy != nil {
+		var handler = a.proxy.handler
+		mx = handler.mxStatus()
+		monitoring = handler.mx().ConnectionInfo()
+	} else {
+		a.config.mu.RLock()
+		mx.Host = a.config.MX.Host
+		a.config.mu.RUnlock()
+	}
+	a.mu.RUnlock()
+	var result = map[string]interface{}{
+		"version":    agent,
+		"started":    started.UTC().Format(time.RFC3339),
+		"uptime":     int64(time.Since(started).Seconds()),
+		"mx":         mx,
+		"monitoring": monitoring,
+	}
+	if err := a.config.Error(); err != "" {
+		result["error"] = err
+	}
+	a.apiWrite(w, http.StatusOK, result)
+}
+
+// paramJSONItem описывает дополнительный параметр в JSON API.
+type paramJSONItem struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+// apiParams отдает список дополнительных параметров с типизированными
+// значениями и создает новый параметр. Область действия параметров задается
+// параметром запроса scope: без него отдаются параметры всех областей, а
+// создаются глобальные параметры.
+func (a *Admin) apiParams(w http.ResponseWriter, r *http.Request, scope string) {
+	switch r.Method {
+	case "GET":
+		a.config.mu.RLock()
+		var result = make(map[string]interface{})
+		if scope != "" {
+			var params, _ = a.config.paramsScope(scope, false)
+			result["scope"] = scope
+			result["params"] = copyParams(params)
+		} else {
+			result["params"] = copyParams(a.config.Params)
+			result["groups"] = copyScopes(a.config.GroupParams)
+			result["exts"] = copyScopes(a.config.ExtParams)
+		}
+		a.config.mu.RUnlock()
+		a.apiWrite(w, http.StatusOK, result)
+	case "POST":
+		var param paramJSONItem
+		if err := readJSON(w, r, &param); err != nil {
+			a.apiError(w, http.StatusBadRequest, "bad json: "+err.Error())
+			return
+		}
+		a.apiSetParam(w, r, scope, param.Key, param.Type, param.Value, true)
+	default:
+		a.apiMethodNotAllowed(w, "GET, POST")
+	}
+}
+
+// apiParam отдает, изменяет и удаляет дополнительный параметр.
+func (a *Admin) apiParam(w http.ResponseWriter, r *http.Request, scope, key string) {
+	switch r.Method {
+	case "GET":
+		a.config.mu.RLock()
+		var params, _ = a.config.paramsScope(scope, false)
+		value, ok := params[key]
+		a.config.mu.RUnlock()
+		if !ok {
+			a.apiError(w, http.StatusNotFound, "param not found")
+			return
+		}
+		a.apiWrite(w, http.StatusOK, &paramJSONItem{
+			Key: key, Type: paramType(value), Value: value})
+	case "PUT":
+		var param paramJSONItem
+		if err := readJSON(w, r, &param); err != nil {
+			a.apiError(w, http.StatusBadRequest, "bad json: "+err.Error())
+			return
+		}
+		a.apiSetParam(w, r, scope, key, param.Type, param.Value, false)
+	case "DELETE":
+		a.config.mu.RLock()
+		var params, _ = a.config.paramsScope(scope, false)
+		_, ok := params[key]
+		var overridden = a.config.paramOverridden(scope, key)
+		a.config.mu.RUnlock()
+		switch {
+		case !ok:
+			a.apiError(w, http.StatusNotFound, "param not found")
+			return
+		case overridden:
+			a.apiError(w, http.StatusConflict, "params."+key+" is overridden")
+			return
+		}
+		_, _, err := a.changeConfig(r, false, func(config *Config) []string {
+			config.deleteParam(scope, key)
+			return nil
+		})
+		if err != nil {
+			a.apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		a.apiMethodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
+
+// apiSetParam создает или изменяет дополнительный параметр. Если create
+// установлен, то параметр с таким именем не должен существовать.
+func (a *Admin) apiSetParam(w http.ResponseWriter, r *http.Request,
+	scope, key, typ string, value json.RawMessage, create bool) {
+	key = strings.TrimSpace(key)
+	var name = "params." + key
+	if checkField(name, "") != nil {
+		a.apiError(w, http.StatusBadRequest, "bad param name")
+		return
+	}
+	value, err := paramValue(typ, value)
+	if err != nil {
+		a.apiError(w, http.StatusBadRequest, name+": "+err.Error())
+		return
+	}
+	a.config.mu.RLock()
+	var params, _ = a.config.paramsScope(scope, false)
+	_, exists := params[key]
+	var overridden = a.config.paramOverridden(scope, key)
+	a.config.mu.RUnlock()
+	switch {
+	case create && exists:
+		a.apiError(w, http.StatusConflict, "param already exists")
+		return
+	case overridden:
+		a.apiError(w, http.StatusConflict, name+" is overridden")
+		return
+	}
+	_, errs, err := a.changeConfig(r, false, func(config *Config) []string {
+		if err := config.setParam(scope, key, paramJSON, string(value)); err != nil {
+			return []string{err.Error()}
+		}
+		return nil
+	})
+	if err != nil {
+		a.apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(errs) > 0 {
+		a.apiError(w, http.StatusBadRequest, strings.Join(errs, "; "))
+		return
+	}
+	var status = http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+	a.apiWrite(w, status, &paramJSONItem{
+		Key: key, Type: paramType(value), Value: value})
+}
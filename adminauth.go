@@ -0,0 +1,409 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// параметры авторизации в административном интерфейсе
+var (
+	adminCookieName   = lowerAppName + "_admin" // имя cookie с идентификатором сессии
+	adminSessionTTL   = time.Minute * 30        // время жизни неактивной сессии
+	adminMaxFailures  = 5                       // количество неудачных попыток до блокировки
+	adminLockout      = time.Minute * 15        // время блокировки после неудачных попыток
+	adminSecureCookie = false                   // cookie сессии передается только по HTTPS
+)
+
+// adminDummyHash используется для проверки пароля неизвестного логина, чтобы
+// время ответа не выдавало существующие логины администраторов.
+var adminDummyHash = []byte("$2a$10$dmkeamOoktCl1Gr/RUbb9O9yvGz/Tc8gtwu9V3SCVuRUWfVeqjzjC")
+
+// adminSession описывает сессию авторизованного администратора.
+type adminSession struct {
+	Login   string    // логин администратора
+	CSRF    string    // токен для защиты форм от CSRF
+	totp    []byte    // ключ двухфакторной авторизации до его подтверждения
+	expires time.Time // время окончания действия сессии
+}
+
+// AdminSessions хранит сессии администраторов.
+type AdminSessions struct {
+	sessions map[string]*adminSession
+	mu       sync.Mutex
+}
+
+// randomString возвращает случайную строку, сформированную из указанного
+// количества байт.
+func randomString(size int) (string, error) {
+	var data = make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Start создает новую сессию администратора и возвращает ее идентификатор.
+func (s *AdminSessions) Start(login string) (string, error) {
+	id, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	csrf, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	var now = time.Now()
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*adminSession)
+	}
+	// удаляем устаревшие сессии
+	for sid, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, sid)
+		}
+	}
+	s.sessions[id] = &adminSession{
+		Login:   login,
+		CSRF:    csrf,
+		expires: now.Add(adminSessionTTL),
+	}
+	s.mu.Unlock()
+	return id, nil
+}
+
+// Get возвращает сессию с указанным идентификатором и продлевает срок ее
+// действия. Если сессия не найдена или устарела, то возвращается nil.
+func (s *AdminSessions) Get(id string) *adminSession {
+	var now = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	if now.After(session.expires) {
+		delete(s.sessions, id)
+		return nil
+	}
+	session.expires = now.Add(adminSessionTTL)
+	return session
+}
+
+// Stop удаляет сессию с указанным идентификатором.
+func (s *AdminSessions) Stop(id string) {
+	s.mu.Lock()
+	delete(s.sessions, id)
+	s.mu.Unlock()
+}
+
+// StopLogin удаляет все сессии администратора с указанным логином.
+func (s *AdminSessions) StopLogin(login string) {
+	s.mu.Lock()
+	for id, session := range s.sessions {
+		if session.Login == login {
+			delete(s.sessions, id)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// adminAPIKey возвращает строку ключа доступа к API из заголовка X-API-Key
+// или заголовка авторизации с типом ApiKey.
+func adminAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "ApiKey ") {
+		return strings.TrimPrefix(auth, "ApiKey ")
+	}
+	return ""
+}
+
+// apiKeySession проверяет ключ доступа к API с областью доступа admin и
+// возвращает сессию для авторизации запроса к JSON API административного
+// сервера. Изменения записываются в журнал от имени apikey:<название ключа>.
+// При ошибке возвращается nil и статус ответа. Неверные ключи учитываются
+// в ограничении попыток авторизации с IP-адреса.
+func (a *Admin) apiKeySession(r *http.Request, key string) (*adminSession, int) {
+	var ip = remoteIP(r)
+	var limitKey = "ip:" + ip
+	if a.limiter.Locked(limitKey) > 0 {
+		a.log.Warn("admin api key locked", "ip", ip)
+		return nil, http.StatusTooManyRequests
+	}
+	var apiKey = a.config.apiKey(key)
+	if apiKey == nil {
+		a.limiter.Failed(limitKey)
+		a.log.Error("bad admin api key", "ip", ip)
+		return nil, http.StatusUnauthorized
+	}
+	if !apiKey.AllowedScope(scopeAdmin) || !apiKey.AllowedIP(net.ParseIP(ip)) {
+		a.log.Error("admin api key not allowed", "key", apiKey.Name, "ip", ip)
+		return nil, http.StatusForbidden
+	}
+	return &adminSession{Login: "apikey:" + apiKey.Name}, http.StatusOK
+}
+
+// remoteIP возвращает IP-адрес клиента без номера порта.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// adminLoginTemplate используется для отображения страницы авторизации.
+var adminLoginTemplate = template.Must(template.New("").Parse(`<html>
+<title>{{.Version}}</title>
+<form method="POST" action="/login">
+<fieldset><legend>Admin</legend>
+<input name="login" placeholder="admin login" autofocus><br>
+<input name="password" type="password" placeholder="admin password"><br>
+<input name="code" placeholder="two-factor or recovery code" autocomplete="off"><br>
+</fieldset>
+{{if .Error}}<div>{{.Error}}</div>{{end}}
+<input type="submit" value="Login">
+</form>
+</html>`))
+
+// loginPage отдает страницу авторизации с указанной ошибкой.
+func (a *Admin) loginPage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := adminLoginTemplate.Execute(w, map[string]string{
+		"Version": agent,
+		"Error":   message,
+	}); err != nil {
+		a.log.Error("http response error", err)
+	}
+}
+
+// Login отдает страницу авторизации и проверяет логин и пароль
+// администратора, а если для учетной записи подключена двухфакторная
+// авторизация, то и одноразовый код или код восстановления. После
+// нескольких неудачных попыток авторизация с этим логином или с этого
+// IP-адреса временно блокируется.
+func (a *Admin) Login(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		a.loginPage(w, http.StatusOK, "")
+	case "POST":
+		var (
+			login    = r.PostFormValue("login")
+			password = r.PostFormValue("password")
+			keys     = []string{"login:" + login, "ip:" + remoteIP(r)}
+		)
+		if locked := a.limiter.Locked(keys...); locked > 0 {
+			w.Header().Set("Retry-After",
+				strconv.Itoa(int(locked.Seconds()+0.5)))
+			a.loginPage(w, http.StatusTooManyRequests,
+				"Too many failed attempts. Try again later.")
+			a.log.Warn("admin login locked", "login", login, "ip", remoteIP(r))
+			return
+		}
+		a.config.mu.RLock()
+		var hash []byte
+		if account := a.config.admin(login); account != nil {
+			hash = account.Password
+		}
+		a.config.mu.RUnlock()
+		var message string // описание ошибки авторизации
+		if hash == nil {
+			bcrypt.CompareHashAndPassword(adminDummyHash, []byte(password))
+			message = "Bad login or password."
+		} else if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+			message = "Bad login or password."
+		} else {
+			// проверяем одноразовый код, если подключена двухфакторная
+			// авторизация
+			a.config.mu.RLock()
+			var account = a.config.admin(login)
+			var totp = account != nil && account.TOTP != nil
+			a.config.mu.RUnlock()
+			var ok, recovery = true, false
+			if totp {
+				ok, recovery = a.config.verifyCode(login, r.PostFormValue("code"))
+			}
+			if !ok {
+				message = "Bad two-factor code."
+			} else if recovery {
+				if err := a.config.Save(); err != nil {
+					a.log.Error("config save error", err)
+				}
+				securityLog.Warn("admin recovery code used", "login", login,
+					"ip", remoteIP(r))
+			}
+		}
+		if message != "" {
+			if locked := a.limiter.Failed(keys...); locked > 0 {
+				securityLog.Warn("repeated admin login failures",
+					"login", login, "ip", remoteIP(r),
+					"lockout", locked.String())
+			}
+			a.loginPage(w, http.StatusUnauthorized, message)
+			a.log.Error("bad authorization request", "login", login,
+				"ip", remoteIP(r))
+			return
+		}
+		// счетчик IP-адреса не сбрасывается, чтобы успешная авторизация
+		// не снимала ограничение подбора паролей к другим логинам
+		a.limiter.Succeeded(keys[0])
+		if _, err := a.startSession(w, r, login); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			a.log.Error("admin session error", err)
+			return
+		}
+		a.log.Info("admin logged in", "login", login, "ip", remoteIP(r))
+		http.Redirect(w, r, "/", http.StatusFound)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		status := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// startSession создает сессию администратора с указанным логином, передает
+// ее идентификатор в cookie и возвращает созданную сессию.
+func (a *Admin) startSession(w http.ResponseWriter, r *http.Request, login string) (*adminSession, error) {
+	id, err := a.sessions.Start(login)
+	if err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookieName,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   adminSecureCookie || r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return a.sessions.Get(id), nil
+}
+
+// Logout завершает сессию администратора.
+func (a *Admin) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		status := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if cookie, err := r.Cookie(adminCookieName); err == nil {
+		a.sessions.Stop(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   adminSecureCookie || r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	a.log.Info("admin logged out", "login", adminLogin(r))
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// Authorization проверяет, что запрос выполняется в рамках сессии
+// авторизованного администратора, а для запросов, изменяющих данные, —
+// наличие правильного CSRF-токена. Неавторизованные запросы страниц
+// перенаправляются на страницу авторизации. До завершения первоначальной
+// настройки доступна только страница настройки. Проверки работоспособности
+// /healthz и /readyz доступны без авторизации.
+func (a *Admin) Authorization(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// проверки работоспособности и готовности не требуют авторизации
+		switch r.URL.Path {
+		case "/healthz":
+			a.Healthz(w, r)
+			return
+		case "/readyz":
+			// подробности готовности отдаются только авторизованному
+			// администратору
+			if cookie, err := r.Cookie(adminCookieName); err == nil {
+				if session := a.sessions.Get(cookie.Value); session != nil {
+					r = withAdminSession(r, session)
+				}
+			}
+			a.Readyz(w, r)
+			return
+		}
+		var api = strings.HasPrefix(r.URL.Path, adminAPIPrefix)
+		if a.config.setupRequired() {
+			if api {
+				a.apiError(w, http.StatusServiceUnavailable, "setup required")
+			} else if r.URL.Path == "/setup" {
+				a.Setup(w, r)
+			} else if r.Method == "GET" || r.Method == "HEAD" {
+				http.Redirect(w, r, "/setup", http.StatusFound)
+			} else {
+				http.Error(w, "setup required", http.StatusServiceUnavailable)
+			}
+			return
+		}
+		if r.URL.Path == "/login" {
+			a.Login(w, r)
+			return
+		}
+		var session *adminSession
+		// запросы к API могут быть авторизованы ключом доступа с областью
+		// admin вместо сессии; такие запросы не проверяют CSRF-токен
+		var key = adminAPIKey(r)
+		if api && key != "" {
+			var status int
+			if session, status = a.apiKeySession(r, key); session == nil {
+				a.apiError(w, status, http.StatusText(status))
+				return
+			}
+		} else if cookie, err := r.Cookie(adminCookieName); err == nil {
+			session = a.sessions.Get(cookie.Value)
+		}
+		if session == nil {
+			if api {
+				status := http.StatusUnauthorized
+				a.apiError(w, status, http.StatusText(status))
+			} else if r.Method == "GET" || r.Method == "HEAD" {
+				http.Redirect(w, r, "/login", http.StatusFound)
+			} else {
+				status := http.StatusUnauthorized
+				http.Error(w, http.StatusText(status), status)
+			}
+			a.log.Error("no authorized request", "path", r.URL.Path)
+			return
+		}
+		// запросы к API передают CSRF-токен в заголовке
+		var csrf = r.Header.Get("X-CSRF-Token")
+		if csrf == "" && r.Method != "GET" && r.Method != "HEAD" {
+			csrf = r.PostFormValue("csrf")
+		}
+		if session.CSRF != "" && r.Method != "GET" && r.Method != "HEAD" &&
+			subtle.ConstantTimeCompare([]byte(csrf), []byte(session.CSRF)) != 1 {
+			status := http.StatusForbidden
+			if api {
+				a.apiError(w, status, "bad csrf token")
+			} else {
+				http.Error(w, "bad csrf token", status)
+			}
+			a.log.Error("bad csrf token", "login", session.Login,
+				"path", r.URL.Path)
+			return
+		}
+		if api && session.CSRF != "" {
+			w.Header().Set("X-CSRF-Token", session.CSRF)
+		}
+		// обрабатываем запрос после авторизации
+		h.ServeHTTP(w, withAdminSession(r, session))
+	}
+}
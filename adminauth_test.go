@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminDummyHash(t *testing.T) {
+	// проверка неизвестного логина должна занимать столько же времени,
+	// сколько проверка пароля администратора
+	cost, err := bcrypt.Cost(adminDummyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Errorf("dummy hash cost %d, want %d", cost, bcrypt.DefaultCost)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AdminAccount описывает учетную запись администратора.
+type AdminAccount struct {
+	Login    string
+	Password []byte   // bcrypt-хеш пароля
+	TOTP     Secret   `json:",omitempty"` // ключ двухфакторной авторизации
+	Recovery [][]byte `json:",omitempty"` // bcrypt-хеши кодов восстановления
+	totpUsed uint64   // интервал последнего использованного одноразового кода
+}
+
+// adminContextKey используется для сохранения сессии авторизованного
+// администратора в контексте запроса.
+type adminContextKey struct{}
+
+// withAdminSession возвращает запрос с сохраненной в контексте сессией
+// авторизованного администратора.
+func withAdminSession(r *http.Request, session *adminSession) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminContextKey{}, session))
+}
+
+// adminSessionFrom возвращает сессию авторизованного администратора из
+// контекста запроса.
+func adminSessionFrom(r *http.Request) *adminSession {
+	session, _ := r.Context().Value(adminContextKey{}).(*adminSession)
+	return session
+}
+
+// adminLogin возвращает имя авторизованного администратора из контекста
+// запроса.
+func adminLogin(r *http.Request) string {
+	if session := adminSessionFrom(r); session != nil {
+		return session.Login
+	}
+	return ""
+}
+
+// admin возвращает учетную запись администратора с указанным именем.
+// Должна вызываться с блокировкой конфигурации.
+func (c *Config) admin(login string) *AdminAccount {
+	for _, account := range c.Admins {
+		if account.Login == login {
+			return account
+		}
+	}
+	return nil
+}
+
+// Admins отвечает за добавление и удаление учетных записей администраторов и
+// изменение их паролей.
+func (a *Admin) Admins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		status := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var (
+		login    = strings.TrimSpace(r.PostForm.Get("login"))
+		password = r.PostForm.Get("password")
+	)
+	if login == "" {
+		http.Error(w, "admin login required", http.StatusBadRequest)
+		return
+	}
+	var changed bool
+	switch r.PostForm.Get("action") {
+	case "create", "password":
+		if password == "" {
+			http.Error(w, "admin password required", http.StatusBadRequest)
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			a.log.Error("bcrypt password error", err)
+			return
+		}
+		a.config.mu.Lock()
+		if account := a.config.admin(login); account != nil {
+			account.Password = hash
+			a.config.mu.Unlock()
+			if login != adminLogin(r) {
+				a.sessions.StopLogin(login)
+			}
+			a.audit(r, "admins."+login+".password", secretMask, secretMask)
+		} else {
+			a.config.Admins = append(a.config.Admins,
+				&AdminAccount{Login: login, Password: hash})
+			a.config.mu.Unlock()
+			a.audit(r, "admins", "", login)
+		}
+		changed = true
+	case "delete":
+		a.config.mu.Lock()
+		if len(a.config.Admins) < 2 {
+			a.config.mu.Unlock()
+			http.Error(w, "can't delete the last admin", http.StatusBadRequest)
+			return
+		}
+		for i, account := range a.config.Admins {
+			if account.Login == login {
+				a.config.Admins = append(a.config.Admins[:i],
+					a.config.Admins[i+1:]...)
+				changed = true
+				break
+			}
+		}
+		a.config.mu.Unlock()
+		if changed {
+			a.sessions.StopLogin(login)
+			a.audit(r, "admins", login, "")
+		}
+	case "totp": // сброс двухфакторной авторизации другого администратора
+		if login == adminLogin(r) {
+			http.Error(w, "use the two-factor form to disable your own code",
+				http.StatusBadRequest)
+			return
+		}
+		a.config.mu.Lock()
+		if account := a.config.admin(login); account != nil && account.TOTP != nil {
+			account.TOTP, account.Recovery = nil, nil
+			changed = true
+		}
+		a.config.mu.Unlock()
+		if changed {
+			a.sessions.StopLogin(login)
+			a.audit(r, "admins."+login+".totp", "true", "false")
+			securityLog.Warn("admin two-factor reset", "login", login,
+				"by", adminLogin(r))
+		}
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	if changed {
+		if err := a.config.Save(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			a.log.Error("config save error", err)
+			return
+		}
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/rest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// APIKey описывает ключ доступа к API для интеграции с другими серверами.
+// Ключ состоит из открытого идентификатора и секретной части, разделенных
+// точкой. В конфигурации сохраняется только хеш секретной части.
+type APIKey struct {
+	ID      string    // идентификатор ключа
+	Name    string    // название ключа
+	Hash    []byte    // bcrypt-хеш секретной части ключа
+	Scopes  []string  // разрешенные области доступа
+	Exts    []string  // разрешенные внутренние номера; "*" — любые
+	IPs     []string  // разрешенные IP-адреса или подсети; пустой — любые
+	Created time.Time // дата создания
+}
+
+// NewAPIKey создает новый ключ доступа к API и возвращает его описание и
+// строку ключа. Строка ключа нигде не сохраняется, поэтому ее нужно сразу
+// передать пользователю.
+func NewAPIKey(name string, scopes, exts, ips []string) (*APIKey, string, error) {
+	var id = make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	var secret = make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	var secretStr = base64.RawURLEncoding.EncodeToString(secret)
+	hash, err := bcrypt.GenerateFromPassword([]byte(secretStr), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, "", err
+	}
+	var key = &APIKey{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		Hash:    hash,
+		Scopes:  scopes,
+		Exts:    exts,
+		IPs:     ips,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	return key, key.ID + "." + secretStr, nil
+}
+
+// AllowedExt возвращает true, если ключ разрешает доступ к указанному
+// внутреннему номеру.
+func (k *APIKey) AllowedExt(ext string) bool {
+	for _, allowed := range k.Exts {
+		if allowed == "*" || allowed == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedScope возвращает true, если ключу разрешена указанная область
+// доступа.
+func (k *APIKey) AllowedScope(scope string) bool {
+	for _, name := range k.Scopes {
+		if name == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedExt возвращает ошибку, если запрос авторизован ключом API, который
+// не разрешает доступ к указанному внутреннему номеру. Для токенов
+// пользователей ограничение не действует.
+func (t *TokenInfo) allowedExt(ext string) error {
+	if t.Key == nil {
+		return nil
+	}
+	return keyAllowedExt(t.Key, ext)
+}
+
+// keyAllowedExt возвращает ошибку, если ключ API не разрешает доступ к
+// указанному внутреннему номеру или токены пользователя с этим номером были
+// отозваны после создания ключа.
+func keyAllowedExt(key *APIKey, ext string) error {
+	if !key.AllowedExt(ext) {
+		return rest.NewError(http.StatusForbidden, "extension not allowed")
+	}
+	if tokensRevoked(ext, key.Created) {
+		return rest.NewError(http.StatusForbidden, "extension revoked")
+	}
+	return nil
+}
+
+// AllowedIP возвращает true, если ключ разрешает доступ с указанного
+// IP-адреса.
+func (k *APIKey) AllowedIP(ip net.IP) bool {
+	if len(k.IPs) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range k.IPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(allowed); allowedIP != nil &&
+			allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopesList возвращает строку со списком областей доступа ключа.
+func (k *APIKey) ScopesList() string {
+	return strings.Join(k.Scopes, ", ")
+}
+
+// ExtsList возвращает строку со списком разрешенных внутренних номеров.
+func (k *APIKey) ExtsList() string {
+	return strings.Join(k.Exts, ", ")
+}
+
+// IPsList возвращает строку со списком разрешенных IP-адресов.
+func (k *APIKey) IPsList() string {
+	return strings.Join(k.IPs, ", ")
+}
+
+// apiKeysVerified кеширует проверенные ключи, чтобы не вычислять bcrypt-хеш
+// при каждом запросе. Ключом является SHA-256 строки ключа, а значением —
+// его идентификатор.
+var apiKeysVerified sync.Map
+
+// apiKey находит и проверяет ключ доступа к API по его строке. Возвращает
+// nil, если ключ не найден или не прошел проверку.
+func (c *Config) apiKey(key string) *APIKey {
+	var indx = strings.IndexByte(key, '.')
+	if indx < 1 {
+		return nil
+	}
+	var id, secret = key[:indx], key[indx+1:]
+	c.mu.RLock()
+	var found *APIKey
+	for _, apiKey := range c.APIKeys {
+		if apiKey.ID == id {
+			found = apiKey
+			break
+		}
+	}
+	c.mu.RUnlock()
+	if found == nil {
+		return nil
+	}
+	var sum = sha256.Sum256([]byte(key))
+	var cacheKey = hex.EncodeToString(sum[:])
+	if cachedID, ok := apiKeysVerified.Load(cacheKey); ok && cachedID == id {
+		return found
+	}
+	if bcrypt.CompareHashAndPassword(found.Hash, []byte(secret)) != nil {
+		return nil
+	}
+	apiKeysVerified.Store(cacheKey, id)
+	return found
+}
+
+// splitList разбирает строку со списком значений, разделенных запятыми или
+// пробелами.
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+}
+
+// apiKeyInfo проверяет ключ доступа к API и возвращает информацию для
+// авторизации запроса. Внутренний номер, от имени которого выполняется
+// запрос, передается в параметре ext. Если ключ разрешает доступ только к
+// одному внутреннему номеру, то этот параметр можно не указывать.
+func (h *HTTPHandler) apiKeyInfo(c *rest.Context, key string) (*TokenInfo, error) {
+	if h.config == nil {
+		return nil, rest.NewError(http.StatusForbidden, "bad api key")
+	}
+	var apiKey = h.config.apiKey(key)
+	if apiKey == nil {
+		return nil, rest.NewError(http.StatusForbidden, "bad api key")
+	}
+	c.AddLogField("apiKey", apiKey.Name)
+	if !apiKey.AllowedIP(net.ParseIP(remoteIP(c.Request))) {
+		return nil, rest.NewError(http.StatusForbidden, "ip address not allowed")
+	}
+	var t = &TokenInfo{
+		Key:    apiKey,
+		Scopes: apiKey.Scopes,
+	}
+	var exts = splitList(c.Form("ext"))
+	for _, ext := range exts {
+		if err := keyAllowedExt(apiKey, ext); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case len(exts) == 1:
+		t.Ext = exts[0]
+	case len(exts) == 0 && len(apiKey.Exts) == 1 && apiKey.Exts[0] != "*":
+		t.Ext = apiKey.Exts[0]
+		if err := keyAllowedExt(apiKey, t.Ext); err != nil {
+			return nil, err
+		}
+	}
+	if t.Ext != "" {
+		c.AddLogField("ext", t.Ext)
+	}
+	return t, nil
+}
+
+// apiKeyCreatedTemplate используется для однократного отображения строки
+// созданного ключа доступа к API.
+var apiKeyCreatedTemplate = template.Must(template.New("").Parse(`<html>
+<title>API key</title>
+<p>API key <b>{{.Name}}</b> created. Copy it now: it will not be shown again.</p>
+<pre>{{.Key}}</pre>
+<a href="/">Back</a>
+</html>`))
+
+// APIKeys отвечает за создание и удаление ключей доступа к API.
+func (a *Admin) APIKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		status := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.PostForm.Get("action") {
+	case "create":
+		var name = strings.TrimSpace(r.PostForm.Get("name"))
+		if name == "" {
+			http.Error(w, "api key name required", http.StatusBadRequest)
+			return
+		}
+		var scopes []string
+		for _, scope := range r.PostForm["scope"] {
+			if validScope(scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		var ips = splitList(r.PostForm.Get("ips"))
+		for _, ip := range ips {
+			if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+				http.Error(w, "bad ip address: "+ip, http.StatusBadRequest)
+				return
+			}
+		}
+		apiKey, key, err := NewAPIKey(name, scopes,
+			splitList(r.PostForm.Get("exts")), ips)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			a.log.Error("api key generate error", err)
+			return
+		}
+		a.config.mu.Lock()
+		a.config.APIKeys = append(a.config.APIKeys, apiKey)
+		a.config.mu.Unlock()
+		if err := a.config.Save(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			a.log.Error("config save error", err)
+			return
+		}
+		a.audit(r, "apikeys", "", apiKey.Name+" ("+apiKey.ID+")")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := apiKeyCreatedTemplate.Execute(w, map[string]string{
+			"Name": apiKey.Name,
+			"Key":  key,
+		}); err != nil {
+			a.log.Error("http response error", err)
+		}
+		return
+	case "delete":
+		var id = r.PostForm.Get("id")
+		var deleted *APIKey
+		a.config.mu.Lock()
+		for i, apiKey := range a.config.APIKeys {
+			if apiKey.ID == id {
+				a.config.APIKeys = append(a.config.APIKeys[:i],
+					a.config.APIKeys[i+1:]...)
+				deleted = apiKey
+				break
+			}
+		}
+		a.config.mu.Unlock()
+		if deleted != nil {
+			if err := a.config.Save(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				a.log.Error("config save error", err)
+				return
+			}
+			a.audit(r, "apikeys", deleted.Name+" ("+deleted.ID+")", "")
+		}
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
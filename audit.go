@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// secretMask используется вместо значений секретных полей в журнале
+// изменений.
+const secretMask = "********"
+
+// AuditRecord описывает запись в журнале изменений конфигурации.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Admin    string    `json:"admin"`
+	Field    string    `json:"field"`
+	OldValue string    `json:"old,omitempty"`
+	NewValue string    `json:"new,omitempty"`
+}
+
+// AuditLog описывает журнал изменений конфигурации. Записи только
+// добавляются в конец файла в формате JSON, по одной на строку.
+type AuditLog struct {
+	filename string
+	mu       sync.Mutex
+}
+
+// Record добавляет запись об изменении поля конфигурации в журнал.
+func (l *AuditLog) Record(admin, field, oldValue, newValue string) error {
+	data, err := json.Marshal(&AuditRecord{
+		Time:     time.Now().UTC().Truncate(time.Second),
+		Admin:    admin,
+		Field:    field,
+		OldValue: oldValue,
+		NewValue: newValue,
+	})
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.OpenFile(l.filename,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// Records возвращает последние записи из журнала изменений в обратном
+// порядке: от более новых к более старым.
+func (l *AuditLog) Records(limit int) ([]*AuditRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.Open(l.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []*AuditRecord
+	var scanner = bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record = new(AuditRecord)
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			continue // пропускаем поврежденные записи
+		}
+		records = append(records, record)
+		if len(records) > limit {
+			records = records[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// audit записывает изменение поля конфигурации в журнал от имени
+// авторизованного администратора.
+func (a *Admin) audit(r *http.Request, field, oldValue, newValue string) {
+	a.auditAs(adminLogin(r), field, oldValue, newValue)
+}
+
+// auditAs записывает изменение поля конфигурации в журнал от имени
+// указанного администратора или источника изменения.
+func (a *Admin) auditAs(admin, field, oldValue, newValue string) {
+	a.log.Info("config changed", "admin", admin, "field", field)
+	if a.auditLog == nil {
+		return
+	}
+	if err := a.auditLog.Record(admin, field, oldValue, newValue); err != nil {
+		a.log.Error("audit log error", err)
+	}
+}
+
+// auditTemplate используется для отображения журнала изменений.
+var auditTemplate = template.Must(template.New("").Parse(`<html>
+<title>Audit log</title>
+<table>
+<tr><th>Time</th><th>Admin</th><th>Field</th><th>Old</th><th>New</th></tr>
+{{range .}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Admin}}</td><td>{{.Field}}</td><td>{{.OldValue}}</td><td>{{.NewValue}}</td></tr>
+{{end}}</table>
+<a href="/">Back</a>
+</html>`))
+
+// Audit отдает страницу с журналом изменений конфигурации.
+func (a *Admin) Audit(w http.ResponseWriter, r *http.Request) {
+	if a.auditLog == nil {
+		http.NotFound(w, r)
+		return
+	}
+	records, err := a.auditLog.Records(1000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		a.log.Error("audit log read error", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = auditTemplate.Execute(w, records); err != nil {
+		a.log.Error("http response error", err)
+	}
+}
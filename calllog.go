@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdigger/rest"
+)
+
+// CallLogEntry описывает запись в журнале звонков сервера MX. Названия полей
+// в JSON совпадают с названиями полей в событиях о звонках.
+type CallLogEntry struct {
+	RecordID              int64      `xml:"recordId,attr" json:"recordId"`
+	GlobalCallID          string     `xml:"gcid" json:"globalCallId"`
+	Direction             string     `xml:"direction,attr" json:"direction"`
+	Missed                bool       `xml:"missed,attr" json:"missed,omitempty"`
+	CallingDevice         string     `xml:"callingPartyNo" json:"callingDevice"`
+	CallingDisplayName    string     `xml:"callingPartyName" json:"callingDisplayName,omitempty"`
+	CalledDevice          string     `xml:"originalCalledPartyNo" json:"calledDevice"`
+	CalledDisplayName     string     `xml:"originalCalledPartyName" json:"calledDisplayName,omitempty"`
+	LastRedirectionDevice string     `xml:"lastRedirectedPartyNo" json:"lastRedirectionDevice,omitempty"`
+	AnsweringDevice       string     `xml:"connectedPartyNo" json:"answeringDevice,omitempty"`
+	AnsweringDisplayName  string     `xml:"connectedPartyName" json:"answeringDisplayName,omitempty"`
+	ConnectTimestamp      int64      `xml:"connectTimestamp" json:"-"`
+	DisconnectTimestamp   int64      `xml:"disconnectTimestamp" json:"-"`
+	Connected             time.Time  `xml:"-" json:"connected"`
+	Disconnected          *time.Time `xml:"-" json:"disconnected,omitempty"`
+	Duration              int64      `xml:"-" json:"duration"`
+}
+
+// CallLog возвращает журнал звонков пользователя с указанным внутренним
+// номером за указанный период времени. Конец периода в него не включается.
+// Записи упорядочены по времени звонка и идентификатору записи
+// от более новых к более старым.
+func (m *MXServer) CallLog(ext string, from, to time.Time) ([]*CallLogEntry, error) {
+	resp, err := m.conn.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"CallLogRequest"`
+		Ext     string   `xml:"ext,attr"`
+		From    int64    `xml:"fromTimestamp"`
+		To      int64    `xml:"toTimestamp"`
+	}{
+		Ext:  ext,
+		From: from.Unix(),
+		To:   to.Unix() - 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var callLog = new(struct {
+		Calls []*CallLogEntry `xml:"callInfo"`
+	})
+	if err = resp.Decode(callLog); err != nil {
+		return nil, err
+	}
+	for _, call := range callLog.Calls {
+		call.Connected = time.Unix(call.ConnectTimestamp, 0).UTC()
+		if call.DisconnectTimestamp > 0 {
+			var disconnected = time.Unix(call.DisconnectTimestamp, 0).UTC()
+			call.Disconnected = &disconnected
+			call.Duration = call.DisconnectTimestamp - call.ConnectTimestamp
+		}
+	}
+	sort.Slice(callLog.Calls, func(i, j int) bool {
+		var a, b = callLog.Calls[i], callLog.Calls[j]
+		if a.ConnectTimestamp != b.ConnectTimestamp {
+			return a.ConnectTimestamp > b.ConnectTimestamp
+		}
+		return a.RecordID > b.RecordID
+	})
+	return callLog.Calls, nil
+}
+
+// parseTime разбирает строку с датой или датой и временем. Если строка
+// пустая, то возвращается значение по умолчанию.
+func parseTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// callLogCursor описывает позицию следующей страницы журнала звонков:
+// начало запрошенного периода и последнюю отданную запись.
+type callLogCursor struct {
+	From      int64 // начало периода
+	Timestamp int64 // время последней отданной записи
+	RecordID  int64 // идентификатор последней отданной записи
+}
+
+// String возвращает строковое представление позиции. Значения разделяются
+// подчеркиванием, так как знак минус может входить в сами значения.
+func (c *callLogCursor) String() string {
+	return fmt.Sprintf("%d_%d_%d", c.From, c.Timestamp, c.RecordID)
+}
+
+// parseCallLogCursor разбирает строковое представление позиции следующей
+// страницы журнала звонков.
+func parseCallLogCursor(value string) (*callLogCursor, error) {
+	var parts = strings.Split(value, "_")
+	if len(parts) != 3 {
+		return nil, strconv.ErrSyntax
+	}
+	var values [3]int64
+	for i, part := range parts {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = n
+	}
+	return &callLogCursor{
+		From:      values[0],
+		Timestamp: values[1],
+		RecordID:  values[2],
+	}, nil
+}
+
+// after возвращает true, если запись следует за позицией, т.е. еще не была
+// отдана на предыдущих страницах.
+func (c *callLogCursor) after(call *CallLogEntry) bool {
+	return call.ConnectTimestamp < c.Timestamp ||
+		(call.ConnectTimestamp == c.Timestamp && call.RecordID < c.RecordID)
+}
+
+// CallLog отдает журнал звонков пользователя с сервера MX.
+//
+// Период задается параметрами from и to. По умолчанию отдаются звонки за
+// последнюю неделю. Количество записей в ответе ограничивается параметром
+// limit. Если записей больше, то в ответе возвращается поле next, значение
+// которого нужно передать в качестве параметра cursor для получения
+// следующей страницы. При указании cursor параметры from и to
+// игнорируются.
+func (h *HTTPHandler) CallLog(c *rest.Context) error {
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
+	if err != nil {
+		return err
+	}
+	mxs, err := h.commands(token)
+	if err != nil {
+		return err
+	}
+	var ext = token.Ext
+	var from, to time.Time
+	var cursor *callLogCursor
+	if value := c.Form("cursor"); value != "" {
+		if cursor, err = parseCallLogCursor(value); err != nil {
+			return c.Error(http.StatusBadRequest, "bad cursor")
+		}
+		// запрашиваем звонки, включая секунду последней отданной записи:
+		// уже отданные записи этой секунды отбрасываются ниже
+		from = time.Unix(cursor.From, 0)
+		to = time.Unix(cursor.Timestamp+1, 0)
+	} else {
+		to, err = parseTime(c.Form("to"), time.Now())
+		if err != nil {
+			return c.Error(http.StatusBadRequest, "bad to date")
+		}
+		from, err = parseTime(c.Form("from"), to.AddDate(0, 0, -7))
+		if err != nil {
+			return c.Error(http.StatusBadRequest, "bad from date")
+		}
+	}
+	if !from.Before(to) {
+		return c.Error(http.StatusBadRequest, "bad date range")
+	}
+	var limit = 100
+	if value := c.Form("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 1000 {
+			return c.Error(http.StatusBadRequest, "bad limit")
+		}
+	}
+	calls, err := mxs.CallLog(ext, from, to)
+	if err != nil {
+		return err
+	}
+	if cursor != nil {
+		var i = 0
+		for i < len(calls) && !cursor.after(calls[i]) {
+			i++ // пропускаем записи, отданные на предыдущих страницах
+		}
+		calls = calls[i:]
+	}
+	var result = rest.JSON{"calllog": calls}
+	if len(calls) > limit {
+		var last = calls[limit-1]
+		result["calllog"] = calls[:limit]
+		result["next"] = (&callLogCursor{
+			From:      from.Unix(),
+			Timestamp: last.ConnectTimestamp,
+			RecordID:  last.RecordID,
+		}).String()
+	}
+	return c.Write(result)
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseCallLogCursor(t *testing.T) {
+	var tests = []struct {
+		value string
+		want  *callLogCursor // nil — ошибка
+	}{
+		{"1504224000_1505205710_1236", &callLogCursor{1504224000, 1505205710, 1236}},
+		{"-3600_-60_1", &callLogCursor{-3600, -60, 1}},
+		{"0_0_0", &callLogCursor{}},
+		{"1504224000-1505205710-1236", nil},
+		{"1504224000_1505205710", nil},
+		{"1504224000_1505205710_1236_1", nil},
+		{"a_b_c", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		cursor, err := parseCallLogCursor(test.value)
+		switch {
+		case test.want == nil && err == nil:
+			t.Errorf("parseCallLogCursor(%q) = %+v, want error", test.value,
+				cursor)
+		case test.want != nil && err != nil:
+			t.Errorf("parseCallLogCursor(%q) error: %v", test.value, err)
+		case test.want != nil && *cursor != *test.want:
+			t.Errorf("parseCallLogCursor(%q) = %+v, want %+v", test.value,
+				cursor, test.want)
+		case test.want != nil && cursor.String() != test.value:
+			t.Errorf("%+v.String() = %q, want %q", cursor, cursor.String(),
+				test.value)
+		}
+	}
+}
@@ -1,39 +1,56 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/mdigger/log"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Config описывает информацию о конфигурации сервиса.
 type Config struct {
-	Admin struct {
+	Admins []*AdminAccount // учетные записи администраторов
+	// устарело: используйте Admins
+	Admin *struct {
 		Login    string
 		Password []byte
-	}
+	} `json:",omitempty"`
 	Server struct {
-		Host     string
-		LogLevel int8
+		Host            string
+		LogLevel        int8
+		LoginAttempts   int // неудачных попыток авторизации до блокировки
+		LoginLockout    int // время первой блокировки в секундах
+		LoginMaxLockout int // максимальное время блокировки в секундах
+		RateLimit       int // запросов к API в минуту для токена и маршрута
+		CallQuota       int // звонков в час для внутреннего номера
 	}
 	MX struct {
-		Host     string
-		Login    string
-		Password []byte
+		Host         string
+		Login        string
+		Password     Secret // шифруется при наличии ключа
+		UserSessions bool   // команды отправляются через соединения пользователей
 	}
-	Params   map[string]string
-	filename string
-	err      error
-	mu       sync.RWMutex
+	Roles       Roles     // роли пользователей и групп MX
+	APIKeys     []*APIKey // ключи доступа к API
+	Params      map[string]json.RawMessage
+	GroupParams map[string]map[string]json.RawMessage `json:",omitempty"` // параметры групп MX
+	ExtParams   map[string]map[string]json.RawMessage `json:",omitempty"` // параметры внутренних номеров
+	filename    string
+	overrides   map[string]string  // переопределенные значения полей
+	fileValues  map[string]*string // значения переопределенных полей из файла
+	modified    time.Time          // время изменения конфигурационного файла
+	err         error
+	mu          sync.RWMutex
 }
 
-// LoadConfig загружает конфигурацию из файла.
-func LoadConfig(filename string) (*Config, error) {
+// LoadConfig загружает конфигурацию из файла и устанавливает
+// переопределенные значения полей.
+func LoadConfig(filename string, overrides map[string]string) (*Config, error) {
 	var config = new(Config)
 	// загружаем конфигурационный файл
 	file, err := os.Open(filename)
@@ -41,56 +58,144 @@ func LoadConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 	if err == nil {
+		// время изменения файла используется для отслеживания изменений
+		if fi, err := file.Stat(); err == nil {
+			config.modified = fi.ModTime()
+		}
 		err = json.NewDecoder(file).Decode(config)
 		file.Close()
 		if err != nil {
 			return nil, err
 		}
 	}
-	// устанавливаем обязательные значения по умолчанию
-	if config.Admin.Login == "" {
-		config.Admin.Login = "Administrator"
-	}
-	if len(config.Admin.Password) == 0 {
-		password, err := bcrypt.GenerateFromPassword(
-			[]byte(lowerAppName+"adm"), bcrypt.DefaultCost)
-		if err != nil {
-			return nil, err
+	// переносим учетную запись администратора из старого формата конфигурации
+	if config.Admin != nil {
+		if config.Admin.Login != "" && len(config.Admin.Password) > 0 &&
+			config.admin(config.Admin.Login) == nil {
+			config.Admins = append(config.Admins, &AdminAccount{
+				Login:    config.Admin.Login,
+				Password: config.Admin.Password,
+			})
 		}
-		config.Admin.Password = password
+		config.Admin = nil
+	}
+	compactParams(config.Params)
+	for _, params := range config.GroupParams {
+		compactParams(params)
+	}
+	for _, params := range config.ExtParams {
+		compactParams(params)
 	}
+	if err := config.applyOverrides(overrides); err != nil {
+		return nil, err
+	}
+	// устанавливаем обязательные значения по умолчанию; учетная запись
+	// администратора создается при первоначальной настройке
 	if config.Server.Host == "" {
 		config.Server.Host = "localhost:8080"
 	}
-	if level := config.Server.LogLevel; level < 0 {
+	if config.Server.RateLimit == 0 {
+		config.Server.RateLimit = 120
+	}
+	if config.Server.LoginAttempts == 0 {
+		config.Server.LoginAttempts = 5
+	}
+	if config.Server.LoginLockout <= 0 {
+		config.Server.LoginLockout = 60
+	}
+	if config.Server.LoginMaxLockout < config.Server.LoginLockout {
+		config.Server.LoginMaxLockout = 3600
+		if config.Server.LoginMaxLockout < config.Server.LoginLockout {
+			config.Server.LoginMaxLockout = config.Server.LoginLockout
+		}
+	}
+	if config.Roles.Users == nil {
+		config.Roles.Users = make(map[string]string)
+	}
+	if config.Roles.Groups == nil {
+		config.Roles.Groups = make(map[string]string)
+	}
+	if len(config.Params) == 0 {
+		config.Params = map[string]json.RawMessage{
+			"phoneCountry": json.RawMessage(`"EE"`)}
+	}
+	config.filename = filename
+	return config, nil
+}
+
+// loginLimiter возвращает ограничение неудачных попыток авторизации
+// пользователей API в соответствии с конфигурацией.
+func (c *Config) loginLimiter() *LoginLimiter {
+	return &LoginLimiter{
+		Attempts:   c.Server.LoginAttempts,
+		Lockout:    time.Duration(c.Server.LoginLockout) * time.Second,
+		MaxLockout: time.Duration(c.Server.LoginMaxLockout) * time.Second,
+	}
+}
+
+// setupRequired возвращает true, если не создано ни одной учетной записи
+// администратора и требуется первоначальная настройка сервиса.
+func (c *Config) setupRequired() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.Admins) == 0
+}
+
+// setLogLevel устанавливает уровень вывода лога в соответствии со значением
+// из конфигурации: отрицательное значение включает вывод всех сообщений,
+// положительное — только ошибок.
+func setLogLevel(level int8) {
+	if level < 0 {
 		log.SetLevel(log.TRACE)
 	} else if level > 0 {
 		log.SetLevel(log.WARN)
 	} else {
 		log.SetLevel(log.INFO)
 	}
-	if len(config.Params) == 0 {
-		config.Params = map[string]string{"phoneCountry": "EE"}
+}
+
+// logLevelName возвращает название уровня вывода лога, используемое в
+// административном интерфейсе.
+func logLevelName(level int8) string {
+	if level < 0 {
+		return "ALL"
+	} else if level > 0 {
+		return "ERROR"
 	}
-	config.filename = filename
-	return config, nil
+	return "INFO"
 }
 
 // Save сохраняет конфигурационный файл.
 func (c *Config) Save() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	file, err := os.Create(c.filename)
+	data, err := c.encode()
 	if err != nil {
 		return err
 	}
-	enc := json.NewEncoder(file)
-	enc.SetIndent("", "\t")
-	err = enc.Encode(c)
-	if err := file.Close(); err != nil {
+	// файл записывается атомарно с сохранением предыдущей версии
+	if err := writeConfigFile(c.filename, data); err != nil {
 		return err
 	}
-	return err
+	if fi, err := os.Stat(c.filename); err == nil {
+		c.modified = fi.ModTime()
+	}
+	return nil
+}
+
+// encode возвращает содержимое конфигурационного файла. Секреты шифруются,
+// если задан ключ шифрования. Должна вызываться с блокировкой конфигурации.
+func (c *Config) encode() ([]byte, error) {
+	// переопределенные значения в файл не записываются
+	var restore = c.restoreFileValues()
+	defer restore()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // LogExists возвращает true, если каталог с файлами логов существует.
@@ -113,6 +218,16 @@ func (c *Config) Error() string {
 	return ""
 }
 
+// UserRoles возвращает текстовое представление ролей пользователей.
+func (c *Config) UserRoles() string {
+	return rolesText(c.Roles.Users)
+}
+
+// GroupRoles возвращает текстовое представление ролей групп MX.
+func (c *Config) GroupRoles() string {
+	return rolesText(c.Roles.Groups)
+}
+
 // ServerURL возвращает строку с адресом сервера.
 func (c *Config) ServerURL() string {
 	c.mu.RLock()
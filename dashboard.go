@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// dashboardInterval задает периодичность отправки состояния сервиса на
+// страницу мониторинга.
+var dashboardInterval = time.Second * 2
+
+// ServiceStatus описывает состояние сервиса для страницы мониторинга.
+type ServiceStatus struct {
+	Time     time.Time        `json:"time"`            // время получения состояния
+	Version  string           `json:"version"`         // версия сервиса
+	Uptime   int64            `json:"uptime"`          // время работы в секундах
+	MX       *MXStatus        `json:"mx"`              // серверное соединение с MX
+	Monitors []*MonitorStatus `json:"monitors"`        // запущенные мониторы
+	Calls    int              `json:"calls"`           // активные звонки
+	Contacts int              `json:"contacts"`        // размер адресной книги
+	Error    string           `json:"error,omitempty"` // ошибка сервиса
+}
+
+// dashboard возвращает текущее состояние сервиса.
+func (a *Admin) dashboard() *ServiceStatus {
+	var result = &ServiceStatus{
+		Time:     time.Now().UTC(),
+		Version:  agent,
+		Uptime:   int64(time.Since(started).Seconds()),
+		MX:       new(MXStatus),
+		Monitors: make([]*MonitorStatus, 0),
+		Error:    a.config.Error(),
+	}
+	a.mu.RLock()
+	if a.proxy != nil {
+		var handler = a.proxy.handler
+		var mxs = handler.mx()
+		result.MX = handler.mxStatus()
+		result.Monitors = mxs.Monitors()
+		result.Contacts = mxs.ContactsCount()
+	} else {
+		a.config.mu.RLock()
+		result.MX.Host = a.config.MX.Host
+		a.config.mu.RUnlock()
+	}
+	a.mu.RUnlock()
+	for _, monitor := range result.Monitors {
+		result.Calls += monitor.Calls
+	}
+	return result
+}
+
+// PublishDashboard периодически отправляет состояние сервиса подключенным
+// к странице мониторинга администраторам.
+func (a *Admin) PublishDashboard() {
+	for range time.Tick(dashboardInterval) {
+		if a.events.Connected() == 0 {
+			continue
+		}
+		if err := a.events.Event("", "dashboard", a.dashboard()); err != nil {
+			a.log.Error("dashboard event error", err)
+		}
+	}
+}
+
+// dashboardTemplate используется для отображения страницы мониторинга.
+// Начальное состояние отображается сразу, а затем обновляется по событиям
+// SSE.
+var dashboardTemplate = template.Must(template.New("").Parse(`<html>
+<title>Dashboard</title>
+{{with .Message}}<p>{{.}}</p>{{end}}
+<table>
+<tr><th>Version</th><td>{{.Version}}</td></tr>
+<tr><th>Uptime, sec</th><td id="uptime">{{.Uptime}}</td></tr>
+<tr><th>MX</th><td id="mx">{{.MX.Host}}: {{if .MX.Connected}}connected{{else}}disconnected{{end}}</td></tr>
+<tr><th>Connected since</th><td id="since">{{.MX.Since.Format "2006-01-02 15:04:05"}}</td></tr>
+<tr><th>MX error</th><td id="mxerror">{{.MX.LastError}}{{with .MX.LastErrorTime}} ({{.Format "2006-01-02 15:04:05"}}){{end}}</td></tr>
+<tr><th>Active calls</th><td id="calls">{{.Calls}}</td></tr>
+<tr><th>Contacts</th><td id="contacts">{{.Contacts}}</td></tr>
+<tr><th>Error</th><td id="error">{{.Error}}</td></tr>
+</table>
+<table>
+<thead><tr><th>Ext</th><th>Clients</th><th>Supervisors</th><th>Calls</th><th>Last event</th></tr></thead>
+<tbody id="monitors">
+{{range .Monitors}}<tr><td>{{.Ext}}</td><td>{{.Clients}}</td><td>{{.Watchers}}</td><td>{{.Calls}}</td><td>{{with .LastEvent}}{{.Format "2006-01-02 15:04:05"}}{{end}}</td></tr>
+{{end}}</tbody>
+</table>
+<form method="POST" action="/actions">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input name="ext" placeholder="Ext">
+<button name="action" value="disconnect">Disconnect clients</button>
+<button name="action" value="monitor-stop">Stop monitor</button>
+<button name="action" value="revoke">Revoke tokens</button>
+<button name="action" value="logout">Log out</button>
+<button name="action" value="resync">Resync contacts</button>
+</form>
+<a href="/">Back</a>
+<script>
+function text(id, value) { document.getElementById(id).textContent = value; }
+function time(value) { return value ? value.replace("T", " ").replace(/\..*|Z$/, "") : ""; }
+var events = new EventSource("/dashboard/events");
+events.addEventListener("dashboard", function(e) {
+	var d = JSON.parse(e.data);
+	text("uptime", d.uptime);
+	text("mx", d.mx.host + ": " + (d.mx.connected ? "connected" : "disconnected"));
+	text("since", time(d.mx.since));
+	text("mxerror", d.mx.lastError ? d.mx.lastError + " (" + time(d.mx.lastErrorTime) + ")" : "");
+	text("calls", d.calls);
+	text("contacts", d.contacts);
+	text("error", d.error || "");
+	var tbody = document.getElementById("monitors");
+	tbody.textContent = "";
+	d.monitors.forEach(function(m) {
+		var tr = tbody.insertRow();
+		[m.ext, m.clients, m.watchers, m.calls, time(m.lastEvent)].forEach(function(v) {
+			tr.insertCell().textContent = v;
+		});
+	});
+});
+</script>
+</html>`))
+
+// Dashboard отдает страницу мониторинга состояния сервиса, а по адресу
+// /dashboard/events — поток событий SSE с его обновлениями.
+func (a *Admin) Dashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		status := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	switch r.URL.Path {
+	case "/dashboard":
+	case "/dashboard/events":
+		a.events.ServeHTTP(w, r)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	var csrf string
+	if session := adminSessionFrom(r); session != nil {
+		csrf = session.CSRF
+	}
+	var data = &struct {
+		*ServiceStatus
+		CSRF    string // токен для защиты форм от CSRF
+		Message string // результат административного действия
+	}{
+		ServiceStatus: a.dashboard(),
+		CSRF:          csrf,
+		Message:       r.URL.Query().Get("message"),
+	}
+	var buf bytes.Buffer
+	if err := dashboardTemplate.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		a.log.Error("template error", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := buf.WriteTo(w); err != nil {
+		a.log.Error("http response error", err)
+	}
+}
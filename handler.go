@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"mime"
 	"net"
@@ -15,62 +17,122 @@ import (
 	"github.com/mdigger/log"
 	"github.com/mdigger/mx"
 	"github.com/mdigger/rest"
-	"github.com/mdigger/sse"
 )
 
 // HTTPHandler отвечает за обработку HTTP-запросов.
 type HTTPHandler struct {
-	mxServer *MXServer
-	stopped  bool // флаг остановки сервиса
-	mu       sync.RWMutex
+	mxServer     *MXServer
+	userSessions bool          // флаг отправки команд через соединения пользователей
+	config       *Config       // конфигурация сервиса
+	loginLimiter *LoginLimiter // ограничение неудачных попыток авторизации
+	rateLimiter  *RateLimiter  // ограничение частоты запросов к API
+	callQuota    *RateLimiter  // ограничение количества звонков
+	sessions     sync.Map      // пользовательские соединения с сервером MX
+	stopped      bool          // флаг остановки сервиса
+	mxErr        error         // ошибка серверного соединения до переподключения
+	mxSince      time.Time     // время подключения к серверу MX
+	mxLastErr    error         // последняя ошибка серверного соединения
+	mxLastErrAt  time.Time     // время последней ошибки серверного соединения
+	mu           sync.RWMutex
 }
 
+// errMXDisconnected используется, если соединение с сервером MX было
+// разорвано без ошибки.
+var errMXDisconnected = errors.New("mx connection closed")
+
 // NewHTTPHandler инициализирует и возвращает обработчик HTTP-запросов к
 // серверу MX.
 func NewHTTPHandler(host, login, password string) (*HTTPHandler, error) {
+	host = mxHostPort(host)
+	mxServer, err := NewMXServer(host, login, password)
+	if err != nil {
+		return nil, err
+	}
+	var handler = &HTTPHandler{mxServer: mxServer, mxSince: time.Now()}
+	// запускаем мониторинг разрыва соединения с сервером MX
+	go handler.watch(mxServer, host, login, password)
+	return handler, nil
+}
+
+// mxHostPort добавляет к адресу сервера MX порт по умолчанию, если он не
+// указан.
+func mxHostPort(host string) string {
 	if _, _, err := net.SplitHostPort(host); err != nil {
 		err, ok := err.(*net.AddrError)
 		if ok && err.Err == "missing port in address" {
 			host = net.JoinHostPort(host, "7778")
 		}
 	}
-	mxServer, err := NewMXServer(host, login, password)
+	return host
+}
+
+// watch отслеживает разрыв соединения с сервером MX и переподключается к
+// нему. Отслеживание прекращается при остановке сервиса или замене
+// соединения.
+func (h *HTTPHandler) watch(mxs *MXServer, host, login, password string) {
+wait:
+	var err = <-mxs.conn.Done()
+reconnect:
+	// прекращаем, если это остановка сервиса или соединение было заменено
+	h.mu.RLock()
+	if h.stopped || h.mxServer != mxs {
+		h.mu.RUnlock()
+		return
+	}
+	h.mu.RUnlock()
 	if err != nil {
-		return nil, err
+		log.Error("mx connection error", err)
+	} else {
+		err = errMXDisconnected
 	}
-	var handler = &HTTPHandler{mxServer: mxServer}
-	// запускаем мониторинг разрыва соединения с сервером MX
-	go func(mxs *MXServer) {
-	wait:
-		var err = <-mxs.conn.Done()
-	reconnect:
-		// прекращаем, если это остановка сервиса
-		handler.mu.RLock()
-		if handler.stopped {
-			handler.mu.RUnlock()
+	h.mu.Lock()
+	h.mxErr, h.mxLastErr, h.mxLastErrAt = err, err, time.Now()
+	h.mu.Unlock()
+	log.Info("reconnecting to mx", "delay", time.Minute.String())
+	time.Sleep(time.Minute) // задержка перед переподключением
+	// подключаемся к серверу MX
+	newMXS, err := NewMXServer(host, login, password)
+	if err != nil {
+		if _, ok := err.(*mx.LoginError); ok {
+			log.Error("mx connection login error", err)
 			return
 		}
-		handler.mu.RUnlock()
-		if err != nil {
-			log.Error("mx connection error", err)
-		}
-		log.Info("reconnecting to mx", "delay", time.Minute.String())
-		time.Sleep(time.Minute) // задержка перед переподключением
-		mxs, err = NewMXServer(host, login, password)
-		// подключаемся к серверу MX
-		if err != nil {
-			if _, ok := err.(*mx.LoginError); ok {
-				log.Error("mx connection login error", err)
-				return
-			}
-			goto reconnect
-		}
-		handler.mu.Lock()
-		handler.mxServer = mxs
-		handler.mu.Unlock()
-		goto wait
-	}(mxServer)
-	return handler, nil
+		goto reconnect
+	}
+	h.mu.Lock()
+	if h.stopped || h.mxServer != mxs {
+		h.mu.Unlock()
+		newMXS.Close()
+		return
+	}
+	h.mxServer = newMXS
+	h.mxErr, h.mxSince = nil, time.Now()
+	h.mu.Unlock()
+	newMXS.moveMonitors(mxs) // восстанавливаем мониторинг звонков
+	mxs = newMXS
+	goto wait
+}
+
+// reconnect подключается к серверу MX с новыми параметрами и заменяет им
+// текущее соединение. Запущенные мониторы переносятся на новое соединение,
+// поэтому подключенные клиенты SSE продолжают получать события. В случае
+// ошибки подключения текущее соединение сохраняется.
+func (h *HTTPHandler) reconnect(host, login, password string) error {
+	host = mxHostPort(host)
+	newMXS, err := NewMXServer(host, login, password)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	var oldMXS = h.mxServer
+	h.mxServer = newMXS
+	h.mxErr, h.mxSince = nil, time.Now()
+	h.mu.Unlock()
+	newMXS.moveMonitors(oldMXS)
+	oldMXS.conn.Close()
+	go h.watch(newMXS, host, login, password)
+	log.Info("mx reconnected", "host", host, "login", login)
+	return nil
 }
 
 // Close закрывает соединение с сервером MX.
@@ -79,6 +141,11 @@ func (h *HTTPHandler) Close() error {
 	h.stopped = true
 	var err = h.mxServer.Close()
 	h.mu.Unlock()
+	// закрываем пользовательские соединения
+	h.sessions.Range(func(ext, _ interface{}) bool {
+		h.sessionStop(ext.(string))
+		return true
+	})
 	return err
 }
 
@@ -90,6 +157,42 @@ func (h *HTTPHandler) mx() *MXServer {
 	return mxs
 }
 
+// monitorRelease освобождает монитор после отключения клиента. Соединение
+// с сервером MX могло быть переустановлено, поэтому монитор освобождается
+// на текущем соединении.
+func (h *HTTPHandler) monitorRelease(md *monitorData) {
+	h.mx().monitorRelease(md)
+}
+
+// MXStatus описывает состояние серверного соединения с MX.
+type MXStatus struct {
+	Host          string     `json:"host"`                    // адрес сервера MX
+	Connected     bool       `json:"connected"`               // соединение установлено
+	Since         time.Time  `json:"since"`                   // время последнего подключения
+	Error         string     `json:"error,omitempty"`         // ошибка до переподключения
+	LastError     string     `json:"lastError,omitempty"`     // последняя ошибка соединения
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"` // время последней ошибки
+}
+
+// mxStatus возвращает состояние серверного соединения с MX.
+func (h *HTTPHandler) mxStatus() *MXStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var status = &MXStatus{
+		Host:      h.mxServer.mxHost,
+		Connected: h.mxErr == nil,
+		Since:     h.mxSince.UTC(),
+	}
+	if h.mxErr != nil {
+		status.Error = h.mxErr.Error()
+	}
+	if h.mxLastErr != nil {
+		var lastErrAt = h.mxLastErrAt.UTC()
+		status.LastError, status.LastErrorTime = h.mxLastErr.Error(), &lastErrAt
+	}
+	return status
+}
+
 // Check проверяет, что есть подключение к серверу MX. В противном случае
 // возвращает ошибку.
 func (h *HTTPHandler) Check(c *rest.Context) error {
@@ -106,10 +209,33 @@ func (h *HTTPHandler) Login(c *rest.Context) error {
 	if login == "" {
 		return c.Error(http.StatusBadRequest, "login required")
 	}
+	// проверяем, что авторизация для этого логина и адреса не заблокирована
+	var ip = remoteIP(c.Request)
+	var limitKeys = []string{"login:" + login, "ip:" + ip}
+	if h.loginLimiter != nil {
+		if locked := h.loginLimiter.Locked(limitKeys...); locked > 0 {
+			c.SetHeader("Retry-After", strconv.Itoa(int(locked.Seconds()+0.5)))
+			securityLog.Warn("login locked", "login", login, "ip", ip)
+			return c.Error(http.StatusTooManyRequests, "too many login attempts")
+		}
+	}
 	// авторизуем пользователя
-	info, err := h.mx().Login(login, password)
+	var info *mx.Info
+	var err error
+	if h.userSessionsEnabled() {
+		info, err = h.sessionStart(login, password)
+	} else {
+		info, err = h.mx().Login(login, password)
+	}
 	if err != nil {
 		if errLogin, ok := err.(*mx.LoginError); ok {
+			if h.loginLimiter != nil {
+				if locked := h.loginLimiter.Failed(limitKeys...); locked > 0 {
+					securityLog.Warn("repeated login failures",
+						"login", login, "ip", ip,
+						"lockout", locked.String())
+				}
+			}
 			err = c.Error(http.StatusForbidden, errLogin.Error())
 		} else if errNetwork, ok := err.(net.Error); ok && errNetwork.Timeout() {
 			err = c.Error(http.StatusGatewayTimeout, errNetwork.Error())
@@ -118,15 +244,22 @@ func (h *HTTPHandler) Login(c *rest.Context) error {
 		}
 		return err
 	}
+	if h.loginLimiter != nil {
+		// счетчик IP-адреса не сбрасывается, чтобы успешная авторизация
+		// не снимала ограничение подбора паролей к другим логинам
+		h.loginLimiter.Succeeded(limitKeys[0])
+	}
 	// запускаем мониторинг звонков
 	if err = h.mx().MonitorStart(info.Ext); err != nil {
 		return err
 	}
 	// генерируем токен авторизации пользователя
 	token, err := jwtConfig.Token(jwt.JSON{
-		"sub": info.JID,
-		"ext": info.Ext,
-		"mx":  info.SN,
+		"sub":  info.JID,
+		"ext":  info.Ext,
+		"mx":   info.SN,
+		"role": h.userRole(info.Ext),
+		"nsec": time.Now().UnixNano(),
 	})
 	if err != nil {
 		return err
@@ -142,32 +275,136 @@ func (h *HTTPHandler) Login(c *rest.Context) error {
 	})
 }
 
-// tokenExt проверяет токен авторизации и возвращает внутренний номер
-// пользователя MX.
-func (h *HTTPHandler) tokenExt(c *rest.Context) (string, error) {
+// TokenInfo описывает информацию из токена авторизации пользователя или
+// ключа доступа к API.
+type TokenInfo struct {
+	Sub    mx.JID   `json:"sub"`  // уникальный идентификатор пользователя
+	Ext    string   `json:"ext"`  // внутренний номер пользователя
+	Role   string   `json:"role"` // роль пользователя
+	Issued int64    `json:"iat"`  // время создания токена
+	Nsec   int64    `json:"nsec"` // время создания токена в наносекундах
+	Key    *APIKey  `json:"-"`    // ключ доступа к API
+	Scopes []string `json:"-"`    // области доступа ключа API
+}
+
+// Subject возвращает строку с идентификатором пользователя или ключа API,
+// которая используется для ограничения частоты запросов.
+func (t *TokenInfo) Subject() string {
+	if t.Key != nil {
+		return "key:" + t.Key.ID
+	}
+	return "user:" + strconv.FormatUint(uint64(t.Sub), 10)
+}
+
+// tokenContextKey используется для сохранения проверенного токена в
+// контексте запроса.
+type tokenContextKey struct{}
+
+// tokenInfo возвращает содержимое токена авторизации. Токен, уже
+// проверенный при проверке прав доступа, берется из контекста запроса, а
+// иначе проверяется заново.
+func (h *HTTPHandler) tokenInfo(c *rest.Context) (*TokenInfo, error) {
+	if t, ok := c.Request.Context().Value(tokenContextKey{}).(*TokenInfo); ok {
+		return t, nil
+	}
+	return h.verifyToken(c)
+}
+
+// withTokenInfo сохраняет проверенный токен в контексте запроса.
+func withTokenInfo(c *rest.Context, t *TokenInfo) {
+	c.Request = c.Request.WithContext(
+		context.WithValue(c.Request.Context(), tokenContextKey{}, t))
+}
+
+// verifyToken проверяет токен авторизации и возвращает его содержимое.
+// Вместо токена может использоваться ключ доступа к API, переданный в
+// заголовке X-API-Key или в заголовке авторизации с типом ApiKey.
+func (h *HTTPHandler) verifyToken(c *rest.Context) (*TokenInfo, error) {
+	if key := c.Header("X-API-Key"); key != "" {
+		return h.apiKeyInfo(c, key)
+	}
 	var token = c.Request.FormValue("access_token")
 	if token == "" {
 		// запрашивает токен авторизации из заголовка
 		var auth = c.Header("Authorization")
+		if strings.HasPrefix(auth, "ApiKey ") {
+			return h.apiKeyInfo(c, strings.TrimPrefix(auth, "ApiKey "))
+		}
 		if !strings.HasPrefix(auth, "Bearer ") {
 			c.SetHeader("WWW-Authenticate",
 				fmt.Sprintf("Bearer realm=%q", appName))
-			return "", rest.ErrUnauthorized
+			return nil, rest.ErrUnauthorized
 		}
 		token = strings.TrimPrefix(auth, "Bearer ")
 	}
 	// проверяем токен и получаем его содержимое
 	data, err := jwt.Verify(token, jwtConfig.Key)
 	if err != nil {
-		return "", rest.NewError(http.StatusForbidden, err.Error())
+		return nil, rest.NewError(http.StatusForbidden, err.Error())
 	}
-	var t = new(struct {
-		Ext string `json:"ext"`
-	})
+	var t = new(TokenInfo)
 	if err := json.Unmarshal(data, t); err != nil {
-		return "", rest.NewError(http.StatusForbidden, err.Error())
+		return nil, rest.NewError(http.StatusForbidden, err.Error())
+	}
+	if tokensRevoked(t.Ext, t.issued()) {
+		return nil, rest.NewError(http.StatusForbidden, "token revoked")
 	}
 	c.AddLogField("ext", t.Ext)
+	return t, nil
+}
+
+// issued возвращает время создания токена. Для токенов без времени в
+// наносекундах используется начало секунды создания.
+func (t *TokenInfo) issued() time.Time {
+	if t.Nsec != 0 {
+		return time.Unix(0, t.Nsec)
+	}
+	return time.Unix(t.Issued, 0)
+}
+
+// revokedTokens содержит время отзыва токенов по внутренним номерам
+// пользователей. Отзыв хранится вне обработчика запросов, поэтому
+// сохраняется при его пересоздании после перезапуска или перезагрузки
+// конфигурации.
+var revokedTokens sync.Map
+
+// revokeTokens отзывает все выданные ранее токены авторизации пользователя с
+// указанным внутренним номером: токены, созданные до этого момента, больше
+// не принимаются. Новые токены можно получить после повторной авторизации.
+func revokeTokens(ext string) {
+	var now = time.Now()
+	revokedTokens.Store(ext, now)
+	// удаляем записи, для которых все отозванные токены уже истекли
+	revokedTokens.Range(func(ext, revoked interface{}) bool {
+		if now.Sub(revoked.(time.Time)) > jwtConfig.Expires {
+			revokedTokens.Delete(ext)
+		}
+		return true
+	})
+}
+
+// tokensRevoked возвращает true, если токены пользователя с указанным
+// внутренним номером, созданные в указанное время, были отозваны. Отзыв
+// действует в течение времени жизни токенов.
+func tokensRevoked(ext string, issued time.Time) bool {
+	revoked, ok := revokedTokens.Load(ext)
+	if !ok {
+		return false
+	}
+	var at = revoked.(time.Time)
+	return issued.Before(at) && time.Since(at) <= jwtConfig.Expires
+}
+
+// tokenExt проверяет токен авторизации и возвращает внутренний номер
+// пользователя MX.
+func (h *HTTPHandler) tokenExt(c *rest.Context) (string, error) {
+	t, err := h.tokenInfo(c)
+	if err != nil {
+		return "", err
+	}
+	if t.Ext == "" {
+		return "", rest.NewError(http.StatusBadRequest, "extension required")
+	}
 	return t.Ext, nil
 }
 
@@ -177,15 +414,24 @@ func (h *HTTPHandler) Logout(c *rest.Context) error {
 	if err != nil {
 		return err
 	}
-	return h.mx().MonitorStop(ext) // останавливаем мониторинг
+	// останавливаем мониторинг, если он не используется супервизорами
+	if _, err = h.mx().MonitorLogout(ext); err != nil {
+		return err
+	}
+	return h.sessionStop(ext)
 }
 
 // MakeCall осуществляет серверный звонок.
 func (h *HTTPHandler) MakeCall(c *rest.Context) error {
-	ext, err := h.tokenExt(c) // распаковываем и проверяем токен
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
 	if err != nil {
 		return err
 	}
+	mxs, err := h.commands(token)
+	if err != nil {
+		return err
+	}
+	var ext = token.Ext
 	var (
 		from = c.Form("from")
 		to   = c.Form("to")
@@ -193,10 +439,22 @@ func (h *HTTPHandler) MakeCall(c *rest.Context) error {
 	if from == "" {
 		from = ext
 	}
+	if err := token.allowedExt(from); err != nil {
+		return err
+	}
 	if to == "" {
 		return c.Error(http.StatusBadRequest, "to field is empty")
 	}
-	callInfo, err := h.mx().MakeCall(from, to)
+	// проверяем квоту на количество звонков с номера, с которого выполняется
+	// звонок; для ключей API квота учитывается отдельно для каждого ключа
+	var quotaKey = from
+	if token.Key != nil {
+		quotaKey = token.Subject() + " " + from
+	}
+	if err := rateLimit(c, h.callQuota, quotaKey); err != nil {
+		return err
+	}
+	callInfo, err := mxs.MakeCall(from, to)
 	if err != nil {
 		return err
 	}
@@ -204,26 +462,39 @@ func (h *HTTPHandler) MakeCall(c *rest.Context) error {
 }
 
 // Events отдает события о звонках в виде SSE.
+//
+// Если в запросе указан список внутренних номеров (ext) или название группы
+// MX (group), то отдаются события всех этих пользователей. Такой запрос
+// доступен только супервизорам и ключам API с соответствующим доступом.
 func (h *HTTPHandler) Events(c *rest.Context) error {
-	ext, err := h.tokenExt(c) // распаковываем и проверяем токен
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
 	if err != nil {
 		return err
 	}
 	if mediatype, _, _ := mime.ParseMediaType(c.Header("Accept")); mediatype != "text/event-source" {
 		return c.Error(http.StatusNotAcceptable, "only sse support")
 	}
-	var broker *sse.Server
-	h.mx().monitors.Range(func(_, data interface{}) bool {
-		var md = data.(*monitorData)
-		if md.Extension == ext {
-			broker = md.Server
-			return false
+	if ext := c.Form("ext"); (ext != "" && ext != token.Ext) ||
+		c.Form("group") != "" {
+		return h.supervisorEvents(c, token)
+	}
+	var ext = token.Ext
+	if ext == "" {
+		return c.Error(http.StatusBadRequest, "extension required")
+	}
+	var md = h.mx().monitor(ext)
+	if token.Key != nil {
+		// для ключей API мониторинг запускается при первом подключении и
+		// останавливается после отключения последнего клиента
+		if md, err = h.mx().monitorAcquire(ext); err != nil {
+			return err
 		}
-		return true
-	})
-	if broker == nil {
+		defer h.monitorRelease(md)
+	}
+	if md == nil {
 		return c.Error(http.StatusForbidden, "not monitored")
 	}
+	var broker = md.broker()
 	var log = log.New("sse")
 	log.Debug("connected", "count", broker.Connected()+1)
 	// запускаем отдачу событий
@@ -232,9 +503,39 @@ func (h *HTTPHandler) Events(c *rest.Context) error {
 	return nil
 }
 
-// ConnectionInfo отдает информацию об активных соединениях и мониторинге.
+// ConnectionInfo отдает состояние сервиса: версию, время работы, состояние
+// серверного соединения с MX, размер адресной книги и запущенные мониторы.
+// Доступно только супервизорам и ключам API с соответствующим доступом; для
+// ключей API отдаются только мониторы разрешенных им номеров.
 func (h *HTTPHandler) ConnectionInfo(c *rest.Context) error {
-	return c.Write(rest.JSON{"monitoring": h.mx().ConnectionInfo()})
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
+	if err != nil {
+		return err
+	}
+	var mxs = h.mx()
+	var monitors = make([]*MonitorStatus, 0)
+	var monitoring = make(map[string]int)
+	for _, monitor := range mxs.Monitors() {
+		if token.Key != nil && !token.Key.AllowedExt(monitor.Ext) {
+			continue // пропускаем номера, не разрешенные для ключа
+		}
+		monitors = append(monitors, monitor)
+		monitoring[monitor.Ext] = monitor.Clients
+	}
+	return c.Write(rest.JSON{
+		"version":    agent,
+		"uptime":     int64(time.Since(started).Seconds()),
+		"mx":         h.mxStatus(),
+		"contacts":   mxs.ContactsCount(),
+		"monitors":   monitors,
+		"monitoring": monitoring,
+	})
+}
+
+// Healthz отвечает на проверку работоспособности сервиса балансировщиком
+// нагрузки. Не требует авторизации и не раскрывает сведений о сервисе.
+func (h *HTTPHandler) Healthz(c *rest.Context) error {
+	return c.Write(rest.JSON{"status": "ok"})
 }
 
 // Contacts отдает список контактов из серверной адресной книги.
@@ -264,7 +565,12 @@ func (h *HTTPHandler) Contacts(c *rest.Context) error {
 
 // CallHangup сбрасывает звонок.
 func (h *HTTPHandler) CallHangup(c *rest.Context) error {
-	if _, err := h.tokenExt(c); err != nil {
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
+	if err != nil {
+		return err
+	}
+	mxs, err := h.commands(token)
+	if err != nil {
 		return err
 	}
 	callID, err := strconv.ParseUint(c.Form("callId"), 10, 64)
@@ -276,12 +582,20 @@ func (h *HTTPHandler) CallHangup(c *rest.Context) error {
 	if deviceID == "" {
 		return c.Error(http.StatusBadRequest, "device id required")
 	}
-	return h.mx().CallHangup(callID, deviceID)
+	if err := token.allowedExt(deviceID); err != nil {
+		return err
+	}
+	return mxs.CallHangup(callID, deviceID)
 }
 
 // CallTransfer перебрасывает звонок.
 func (h *HTTPHandler) CallTransfer(c *rest.Context) error {
-	if _, err := h.tokenExt(c); err != nil {
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
+	if err != nil {
+		return err
+	}
+	mxs, err := h.commands(token)
+	if err != nil {
 		return err
 	}
 	callID, err := strconv.ParseUint(c.Form("callId"), 10, 64)
@@ -293,9 +607,75 @@ func (h *HTTPHandler) CallTransfer(c *rest.Context) error {
 	if deviceID == "" {
 		return c.Error(http.StatusBadRequest, "device id required")
 	}
+	if err := token.allowedExt(deviceID); err != nil {
+		return err
+	}
 	var destination = c.Form("destination")
 	if destination == "" {
 		return c.Error(http.StatusBadRequest, "destination phone required")
 	}
-	return h.mx().CallTransfer(callID, deviceID, destination)
+	return mxs.CallTransfer(callID, deviceID, destination)
+}
+
+// Forwarding отдает информацию о настройках переадресации звонков и режиме
+// "не беспокоить" пользователя.
+func (h *HTTPHandler) Forwarding(c *rest.Context) error {
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
+	if err != nil {
+		return err
+	}
+	mxs, err := h.commands(token)
+	if err != nil {
+		return err
+	}
+	var ext = token.Ext
+	info, err := mxs.Forwarding(ext)
+	if err != nil {
+		return err
+	}
+	return c.Write(info)
+}
+
+// SetForwarding включает или выключает переадресацию звонков пользователя.
+func (h *HTTPHandler) SetForwarding(c *rest.Context) error {
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
+	if err != nil {
+		return err
+	}
+	mxs, err := h.commands(token)
+	if err != nil {
+		return err
+	}
+	var ext = token.Ext
+	var name = c.Form("type")
+	if _, ok := forwardingTypes[name]; !ok {
+		return c.Error(http.StatusBadRequest, "bad forwarding type")
+	}
+	enabled, err := strconv.ParseBool(c.Form("enabled"))
+	if err != nil {
+		return c.Error(http.StatusBadRequest, "bad enabled flag")
+	}
+	var destination = c.Form("destination")
+	if enabled && destination == "" {
+		return c.Error(http.StatusBadRequest, "destination phone required")
+	}
+	return mxs.SetForwarding(ext, name, enabled, destination)
+}
+
+// SetDoNotDisturb включает или выключает режим "не беспокоить" пользователя.
+func (h *HTTPHandler) SetDoNotDisturb(c *rest.Context) error {
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
+	if err != nil {
+		return err
+	}
+	mxs, err := h.commands(token)
+	if err != nil {
+		return err
+	}
+	var ext = token.Ext
+	enabled, err := strconv.ParseBool(c.Form("enabled"))
+	if err != nil {
+		return c.Error(http.StatusBadRequest, "bad enabled flag")
+	}
+	return mxs.SetDoNotDisturb(ext, enabled)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mdigger/rest"
+)
+
+// Readiness описывает готовность сервиса к обработке запросов.
+type Readiness struct {
+	Ready       bool       `json:"ready"`                 // сервис готов
+	MX          *MXStatus  `json:"mx"`                    // серверное соединение с MX
+	Addressbook *time.Time `json:"addressbook,omitempty"` // время загрузки адресной книги
+	Contacts    int        `json:"contacts"`              // размер адресной книги
+	Listener    bool       `json:"listener"`              // HTTP сервер запущен
+	Addr        string     `json:"addr,omitempty"`        // адрес HTTP сервера
+	Error       string     `json:"error,omitempty"`       // ошибка сервиса
+}
+
+// ReadinessChecks описывает результаты проверок готовности сервиса без
+// подробностей, которые отдаются публичным сервером без авторизации.
+type ReadinessChecks struct {
+	Ready       bool `json:"ready"`       // сервис готов
+	MX          bool `json:"mx"`          // серверное соединение с MX установлено
+	Addressbook bool `json:"addressbook"` // адресная книга загружена
+	Listener    bool `json:"listener"`    // HTTP сервер запущен
+}
+
+// checks возвращает результаты проверок готовности без подробностей.
+func (r *Readiness) checks() *ReadinessChecks {
+	return &ReadinessChecks{
+		Ready:       r.Ready,
+		MX:          r.MX.Connected,
+		Addressbook: r.Addressbook != nil,
+		Listener:    r.Listener,
+	}
+}
+
+// readiness возвращает готовность сервиса: соединение с сервером MX
+// установлено и авторизовано, серверная адресная книга загружена, а HTTP
+// сервер принимает запросы. Пока соединение с сервером MX
+// восстанавливается, сервис не готов.
+func (p *Proxy) readiness() *Readiness {
+	var h = p.handler
+	var mxs = h.mx()
+	var result = &Readiness{
+		MX:       h.mxStatus(),
+		Contacts: mxs.ContactsCount(),
+	}
+	if loaded := mxs.AddressbookLoaded(); !loaded.IsZero() {
+		loaded = loaded.UTC()
+		result.Addressbook = &loaded
+	}
+	p.mu.RLock()
+	result.Addr = p.server.Addr
+	result.Listener = p.err == nil
+	if p.err != nil {
+		result.Error = p.err.Error()
+	}
+	p.mu.RUnlock()
+	h.mu.RLock()
+	var stopped = h.stopped
+	h.mu.RUnlock()
+	if stopped {
+		result.MX.Connected = false
+	}
+	result.Ready = result.MX.Connected && result.Addressbook != nil &&
+		result.Listener
+	return result
+}
+
+// readinessStatus возвращает статус HTTP-ответа для проверки готовности.
+func readinessStatus(readiness *Readiness) int {
+	if readiness.Ready {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+// Readyz отвечает на проверку готовности сервиса к обработке запросов.
+// Не требует авторизации, поэтому отдает только результаты проверок без
+// адресов и описаний ошибок. Если сервис не готов, то возвращается статус
+// 503.
+func (p *Proxy) Readyz(c *rest.Context) error {
+	var readiness = p.readiness()
+	return writeJSON(c.Response, readinessStatus(readiness), readiness.checks())
+}
+
+// Healthz отвечает на проверку работоспособности процесса административного
+// сервера.
+func (a *Admin) Healthz(w http.ResponseWriter, r *http.Request) {
+	a.apiWrite(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz отвечает на проверку готовности сервиса на административном
+// сервере. Если сервис не запущен из-за ошибки конфигурации или
+// подключения к серверу MX, то возвращается статус 503. Адреса и описания
+// ошибок отдаются только в рамках сессии администратора, а без авторизации —
+// только результаты проверок.
+func (a *Admin) Readyz(w http.ResponseWriter, r *http.Request) {
+	a.mu.RLock()
+	var proxy = a.proxy
+	a.mu.RUnlock()
+	var readiness = &Readiness{MX: new(MXStatus)}
+	if proxy != nil {
+		readiness = proxy.readiness()
+	} else {
+		a.config.mu.RLock()
+		readiness.MX.Host = a.config.MX.Host
+		a.config.mu.RUnlock()
+	}
+	if readiness.Error == "" {
+		readiness.Error = a.config.Error()
+	}
+	if readiness.Error == "" && proxy == nil {
+		readiness.Error = errServiceStopped.Error()
+	}
+	if adminSessionFrom(r) == nil {
+		a.apiWrite(w, readinessStatus(readiness), readiness.checks())
+		return
+	}
+	a.apiWrite(w, readinessStatus(readiness), readiness)
+}
@@ -6,11 +6,14 @@ import (
 	"html/template"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/mdigger/jwt"
 	"github.com/mdigger/log"
+	"github.com/mdigger/sse"
 )
 
 // информация о сервисе и версия
@@ -26,6 +29,7 @@ var (
 	adminTemplate  = lowerAppName + ".html"              // шаблон административного интерфейса
 	adminHost      = ":12880"                            // адрес административного сервера
 	logPath        = "/var/log/" + lowerAppName + ".log" // путь к файлам с логами
+	auditName      = lowerAppName + "-audit.log"         // журнал изменений конфигурации
 	manifestName   = "manifest.zip"
 	srcManifestURL = "%host" // строку, которую надо заменить в манифесте на хост сервиса
 
@@ -55,19 +59,64 @@ func init() {
 
 	flag.StringVar(&configName, "config", configName, "config `filename`")
 	flag.StringVar(&adminHost, "admin", adminHost, "admin http server `host`")
+	flag.BoolVar(&adminSecureCookie, "secure", false, "send admin session cookie over https only")
 	flag.StringVar(&adminTemplate, "template", adminTemplate, "admin template `filename`")
 	flag.StringVar(&logPath, "log", logPath, "`path` to log files")
 	flag.StringVar(&manifestName, "manifest", manifestName, "`path` to manifest file")
+	flag.StringVar(&auditName, "audit", auditName, "config audit log `filename`")
 	flag.DurationVar(&jwtConfig.Expires, "token", jwtConfig.Expires, "jwt token `ttl`")
-	flag.Parse()
+	flag.StringVar(&secretKeyName, "keyfile", secretKeyName, "config secrets key `filename`")
+	flag.BoolVar(&encryptConfig, "encrypt", false, "encrypt config secrets and exit")
+	flag.IntVar(&configBackups, "backups", configBackups, "`number` of config backups to keep")
+	defineOverrideFlags()
 }
 
+// encryptConfig задает шифрование секретов существующего конфигурационного
+// файла с завершением работы.
+var encryptConfig bool
+
 func main() {
-	config, err := LoadConfig(configName)
+	// параметры разбираются в main, а не в init, чтобы не мешать тестам
+	flag.Parse()
+	// загружаем ключ шифрования секретов конфигурации
+	var err error
+	if secretKey, err = LoadSecretKey(); err != nil {
+		log.Error("config secret key error", err)
+		os.Exit(2)
+	}
+	config, err := LoadConfig(configName, ConfigOverrides())
 	if err != nil {
 		log.Error("config error", err)
 		os.Exit(2)
 	}
+	setLogLevel(config.Server.LogLevel)
+	if encryptConfig {
+		// создаем новый ключ, если он еще не задан
+		if secretKey == nil {
+			if secretKey, err = NewSecretKey(); err != nil {
+				log.Error("config secret key error", err)
+				os.Exit(2)
+			}
+			log.Info("config secret key created", "file", secretKeyName)
+		}
+		if err = config.Save(); err != nil {
+			log.Error("config save error", err)
+			os.Exit(2)
+		}
+		// резервные копии содержат секреты в прежнем виде
+		count, err := encryptConfigVersions(configName)
+		if err != nil {
+			log.Error("config versions encrypt error", err)
+			os.Exit(2)
+		}
+		log.Info("config secrets encrypted", "file", configName,
+			"versions", count)
+		return
+	}
+	if secretKey == nil {
+		log.Warn("config secrets are not encrypted: secret key is not set",
+			"env", secretKeyEnv, "file", secretKeyName)
+	}
 	tmpl, err := template.ParseFiles(adminTemplate)
 	if err != nil {
 		log.Error("admin template error", err)
@@ -77,22 +126,53 @@ func main() {
 	log.Debug("jwt sign key", "key",
 		base64.RawURLEncoding.EncodeToString(jwtConfig.Key.([]byte)))
 
-	// запускаем прокси
-	proxy, err := NewProxy(config)
-	if err != nil {
-		config.err = err
+	// запускаем прокси, если не требуется первоначальная настройка
+	var proxy *Proxy
+	if !config.setupRequired() {
+		proxy, err = NewProxy(config)
+		if err != nil {
+			config.err = err
+		}
 	}
 
 	// запускаем административный веб сервер
+	adminLimiter := &LoginLimiter{
+		Attempts:   adminMaxFailures,
+		Lockout:    adminLockout,
+		MaxLockout: adminLockout,
+	}
 	admin := &Admin{
-		config: config,
-		tmpl:   tmpl,
-		proxy:  proxy,
-		log:    log.New("admin"),
+		config:   config,
+		tmpl:     tmpl,
+		proxy:    proxy,
+		auditLog: &AuditLog{filename: auditName},
+		limiter:  adminLimiter,
+		events:   new(sse.Server),
+		log:      log.New("admin"),
+	}
+	if config.setupRequired() {
+		// для первоначальной настройки требуется токен, выводимый в лог
+		if admin.setupToken, err = randomString(16); err != nil {
+			admin.log.Error("setup token error", err)
+			os.Exit(2)
+		}
+		admin.log.Warn("first-run setup required", "path", "/setup",
+			"token", admin.setupToken)
 	}
 	adminMux := http.NewServeMux()
 	adminMux.HandleFunc("/", admin.Config)
 	adminMux.HandleFunc("/manifest.zip", admin.Manifest)
+	adminMux.HandleFunc("/apikeys", admin.APIKeys)
+	adminMux.HandleFunc("/admins", admin.Admins)
+	adminMux.HandleFunc("/audit", admin.Audit)
+	adminMux.HandleFunc("/versions", admin.Versions)
+	adminMux.HandleFunc("/params", admin.Params)
+	adminMux.HandleFunc("/dashboard", admin.Dashboard)
+	adminMux.HandleFunc("/dashboard/", admin.Dashboard)
+	adminMux.HandleFunc("/actions", admin.Actions)
+	adminMux.HandleFunc(adminAPIPrefix, admin.API)
+	adminMux.HandleFunc("/totp", admin.TOTP)
+	adminMux.HandleFunc("/logout", admin.Logout)
 	// отображаем либо каталог с логами, либо содержимое файла лога
 	if fi, err := os.Stat(logPath); err != nil || fi.IsDir() {
 		adminMux.Handle("/log/", http.StripPrefix(
@@ -107,6 +187,17 @@ func main() {
 		Handler:  admin.Authorization(adminMux), // проверяем авторизацию
 		ErrorLog: admin.log.StdLog(log.ERROR),
 	}
+	// перезагружаем конфигурацию при изменении файла или по сигналу SIGHUP
+	go admin.WatchConfig()
+	go admin.PublishDashboard()
+	go func() {
+		var signals = make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		for range signals {
+			admin.log.Info("config reload signal")
+			admin.Reload("SIGHUP")
+		}
+	}()
 	admin.log.Info("service started", "addr", adminServer.Addr, "https", false)
 	err = adminServer.ListenAndServe()
 	adminServer.Close()
@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/xml"
+	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/mdigger/log"
 	"github.com/mdigger/mx"
@@ -12,10 +14,14 @@ import (
 
 // MXServer позволяет отслеживать информацию о звонках на сервер MX.
 type MXServer struct {
-	mxHost   string   // адрес сервера
-	conn     *mx.Conn // серверное соединение с MX
-	monitors sync.Map // идентификаторы запущенных мониторов и внутренние номера пользователей
-	ab       sync.Map // серверная адресная книга
+	mxHost   string    // адрес сервера
+	conn     *mx.Conn  // серверное соединение с MX
+	monitors sync.Map  // идентификаторы запущенных мониторов и внутренние номера пользователей
+	ab       sync.Map  // серверная адресная книга
+	abLoaded time.Time // время загрузки адресной книги
+	groups   []*Group  // кеш списка групп пользователей
+	groupsAt time.Time // время загрузки списка групп
+	mu       sync.RWMutex
 }
 
 // NewMXServer подключается и возвращает серверное соединение с MX для
@@ -48,6 +54,7 @@ func NewMXServer(mxHost, login, password string) (*MXServer, error) {
 	for _, contact := range contacts {
 		monitor.ab.Store(contact.JID, contact)
 	}
+	monitor.abLoaded = time.Now()
 	go monitor.monitoring() // запускаем мониторинг звонков
 	return monitor, nil
 }
@@ -62,12 +69,34 @@ func (m *MXServer) Close() error {
 	return m.conn.Close()
 }
 
-// Login авторизует пользователя MX и возвращает информацию о нем.
-func (m *MXServer) Login(login, password string) (*mx.Info, error) {
+// CheckMXServer проверяет возможность подключения и авторизации на сервере
+// MX с указанными параметрами серверного соединения.
+func CheckMXServer(mxHost, login, password string) error {
+	conn, err := mx.Connect(mxHostPort(mxHost))
+	if err != nil {
+		return err
+	}
+	conn.SetLogger(log.New("mx-check"))
+	if _, err = conn.Login(mx.Login{
+		UserName: login,
+		Password: password,
+		Type:     "Server",
+		Platform: "iPhone",
+		Version:  "1.0",
+	}); err == nil {
+		conn.Logout()
+	}
+	conn.Close()
+	return err
+}
+
+// UserConnect подключается к серверу MX с авторизацией пользователя и
+// возвращает открытое соединение и информацию о пользователе.
+func (m *MXServer) UserConnect(login, password string) (*mx.Conn, *mx.Info, error) {
 	log.Info("check mx login", "login", login)
 	conn, err := mx.Connect(m.mxHost)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	conn.SetLogger(log.New("mx-login: " + login))
 	loginInfo, err := conn.Login(mx.Login{
@@ -77,37 +106,180 @@ func (m *MXServer) Login(login, password string) (*mx.Info, error) {
 		Platform: "CRM",
 		Version:  "1.0",
 	})
-	conn.Logout()
-	conn.Close()
+	if err != nil {
+		conn.Logout()
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, loginInfo, nil
+}
+
+// Login авторизует пользователя MX и возвращает информацию о нем. Соединение
+// пользователя сразу закрывается.
+func (m *MXServer) Login(login, password string) (*mx.Info, error) {
+	conn, loginInfo, err := m.UserConnect(login, password)
 	if err != nil {
 		return nil, err
 	}
+	conn.Logout()
+	conn.Close()
 	return loginInfo, nil
 }
 
 // monitorData описывает ассоциированные с монитором данные.
 type monitorData struct {
-	Extension   string // внутренний номер пользователя
-	*sse.Server        // SSE-брокер для мониторинга событий
+	Extension string             // внутренний номер пользователя
+	events    *sse.Server        // SSE-брокер для мониторинга событий
+	watchers  sync.Map           // SSE-брокеры супервизоров, получающие копии событий
+	lastEvent time.Time          // время последнего события
+	calls     map[int64]struct{} // активные звонки
+	login     bool               // монитор запущен при авторизации пользователя
+	refs      int                // подключения супервизоров и ключей API
+	mu        sync.Mutex
 }
 
-// MonitorStart запускает пользовательский монитор.
-func (m *MXServer) MonitorStart(ext string) error {
-	// проверяем, что монитор еще не запущен
-	var started bool
+// broker возвращает SSE-брокер пользователя для мониторинга событий.
+func (md *monitorData) broker() *sse.Server {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	return md.events
+}
+
+// Connected возвращает количество подключенных к монитору клиентов SSE.
+func (md *monitorData) Connected() int {
+	return md.broker().Connected()
+}
+
+// Close закрывает SSE-брокер и отключает подключенных к нему клиентов.
+func (md *monitorData) Close() {
+	md.broker().Close()
+}
+
+// disconnect отключает подключенных к монитору клиентов SSE, не останавливая
+// сам монитор: для новых подключений создается новый SSE-брокер. Возвращает
+// количество отключенных клиентов.
+func (md *monitorData) disconnect() int {
+	md.mu.Lock()
+	var broker = md.events
+	md.events = new(sse.Server)
+	md.mu.Unlock()
+	var count = broker.Connected()
+	broker.Close()
+	return count
+}
+
+// trackCall отмечает звонок как активный или завершенный.
+func (md *monitorData) trackCall(callID int64, active bool) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if !active {
+		delete(md.calls, callID)
+		return
+	}
+	if md.calls == nil {
+		md.calls = make(map[int64]struct{})
+	}
+	md.calls[callID] = struct{}{}
+}
+
+// send отсылает событие пользователю и всем подписанным на него
+// супервизорам. Для супервизоров к событию добавляется внутренний номер
+// пользователя.
+func (md *monitorData) send(name string, event interface{}) {
+	md.mu.Lock()
+	md.lastEvent = time.Now()
+	var broker = md.events
+	md.mu.Unlock()
+	broker.Event("", name, event)
+	var tagged = &struct {
+		Ext   string      `json:"ext"`
+		Event interface{} `json:"data"`
+	}{
+		Ext:   md.Extension,
+		Event: event,
+	}
+	md.watchers.Range(func(broker, _ interface{}) bool {
+		broker.(*sse.Server).Event("", name, tagged)
+		return true
+	})
+}
+
+// monitor возвращает данные запущенного монитора для указанного внутреннего
+// номера пользователя. Если монитор не запущен, то возвращается nil.
+func (m *MXServer) monitor(ext string) *monitorData {
+	var result *monitorData
 	m.monitors.Range(func(_, data interface{}) bool {
-		started = data.(*monitorData).Extension == ext
-		return !started
+		var md = data.(*monitorData)
+		if md.Extension == ext {
+			result = md
+			return false
+		}
+		return true
 	})
-	if started {
+	return result
+}
+
+// MonitorStart запускает пользовательский монитор при авторизации
+// пользователя. Такой монитор работает до выхода пользователя.
+func (m *MXServer) MonitorStart(ext string) error {
+	// проверяем, что монитор еще не запущен
+	if md := m.monitor(ext); md != nil {
+		md.mu.Lock()
+		md.login = true
+		md.mu.Unlock()
 		return nil // монитор уже запущен
 	}
+	return m.monitorStart(&monitorData{
+		Extension: ext,
+		events:    new(sse.Server),
+		login:     true,
+	})
+}
+
+// monitorAcquire запускает при необходимости монитор для подключения
+// супервизора или ключа API и увеличивает счетчик его подключений. После
+// отключения необходимо вызвать monitorRelease.
+func (m *MXServer) monitorAcquire(ext string) (*monitorData, error) {
+	var md = m.monitor(ext)
+	if md == nil {
+		md = &monitorData{
+			Extension: ext,
+			events:    new(sse.Server),
+		}
+		if err := m.monitorStart(md); err != nil {
+			return nil, err
+		}
+	}
+	md.mu.Lock()
+	md.refs++
+	md.mu.Unlock()
+	return md, nil
+}
+
+// monitorRelease уменьшает счетчик подключений к монитору и останавливает
+// его, если подключений больше не осталось, а пользователь не авторизован.
+func (m *MXServer) monitorRelease(md *monitorData) {
+	md.mu.Lock()
+	md.refs--
+	var idle = md.refs <= 0 && !md.login
+	md.mu.Unlock()
+	if !idle {
+		return
+	}
+	if err := m.monitorStop(md); err != nil {
+		log.Error("monitor stop error", "ext", md.Extension, err)
+	}
+}
+
+// monitorStart запускает на сервере MX монитор для внутреннего номера
+// пользователя и сохраняет его ассоциацию с указанным SSE-брокером.
+func (m *MXServer) monitorStart(md *monitorData) error {
 	// отдаем команду на запуск монитора на сервере MX
 	resp, err := m.conn.SendWithResponse(&struct {
 		XMLName xml.Name `xml:"MonitorStart"`
 		Ext     string   `xml:"monitorObject>deviceObject"`
 	}{
-		Ext: ext,
+		Ext: md.Extension,
 	})
 	if err != nil {
 		return err
@@ -121,20 +293,65 @@ func (m *MXServer) MonitorStart(ext string) error {
 	}
 	// сохраняем номер запущенного монитора и его ассоциацию с внутренним
 	// номером пользователя и SSE-брокером.
-	m.monitors.Store(monitor.ID, &monitorData{
-		Extension: ext,
-		Server:    new(sse.Server),
-	})
+	m.monitors.Store(monitor.ID, md)
 	return nil
 }
 
+// moveMonitors запускает на новом соединении с сервером MX мониторы,
+// запущенные на старом соединении, сохраняя их SSE-брокеры, поэтому
+// подключенные клиенты продолжают получать события. Мониторы, которые не
+// удалось запустить, закрываются.
+func (m *MXServer) moveMonitors(old *MXServer) {
+	old.monitors.Range(func(mID, data interface{}) bool {
+		old.monitors.Delete(mID)
+		var md = data.(*monitorData)
+		// события, пропущенные во время разрыва соединения, не получены,
+		// поэтому список активных звонков начинается заново
+		md.mu.Lock()
+		md.calls = nil
+		md.mu.Unlock()
+		if err := m.monitorStart(md); err != nil {
+			log.Error("monitor restart error", "ext", md.Extension, err)
+			md.Close()
+		}
+		return true
+	})
+}
+
 // MonitorStop останавливает пользовательский монитор.
 func (m *MXServer) MonitorStop(ext string) error {
+	var md = m.monitor(ext)
+	if md == nil {
+		return nil
+	}
+	return m.monitorStop(md)
+}
+
+// MonitorLogout отмечает, что пользователь вышел, и останавливает его
+// монитор, если к нему не подключены супервизоры и клиенты с ключами API.
+// Возвращает true, если монитор был остановлен.
+func (m *MXServer) MonitorLogout(ext string) (bool, error) {
+	var md = m.monitor(ext)
+	if md == nil {
+		return false, nil
+	}
+	md.mu.Lock()
+	md.login = false
+	var idle = md.refs <= 0
+	md.mu.Unlock()
+	if !idle {
+		return false, nil
+	}
+	return true, m.monitorStop(md)
+}
+
+// monitorStop останавливает монитор и отключает его клиентов. Если монитор
+// уже остановлен или перенесен на другое соединение, то ничего не делается.
+func (m *MXServer) monitorStop(md *monitorData) error {
 	// находим идентификатор запущенного монитора пользователя
 	var monitorID int64
 	m.monitors.Range(func(mID, data interface{}) bool {
-		var md = data.(*monitorData)
-		if md.Extension != ext {
+		if data != md {
 			return true
 		}
 		m.monitors.Delete(mID) // удаляем из списка
@@ -193,6 +410,138 @@ type MakeCallResponse struct {
 	CalledDevice string `xml:"calledDevice" json:"called"`
 }
 
+// forwardingTypes задает соответствие между названиями типов переадресации,
+// используемыми в API, и их названиями в CSTA.
+var forwardingTypes = map[string]string{
+	"always":   "forwardImmediate",
+	"busy":     "forwardBusy",
+	"noAnswer": "forwardNoAns",
+}
+
+// ForwardingRule описывает правило переадресации звонков. Используется и в
+// настройках переадресации, и в событиях об их изменении.
+type ForwardingRule struct {
+	Enabled     bool   `json:"enabled"`
+	Destination string `json:"destination,omitempty"`
+}
+
+// forwardDestination разбирает номер, на который переадресуются звонки.
+// Сервер MX передает его в элементе forwardDN в настройках переадресации и
+// в элементе forwardTo в событиях об их изменении.
+type forwardDestination struct {
+	DN string `xml:"forwardDN"`
+	To string `xml:"forwardTo"`
+}
+
+// destination возвращает номер, на который переадресуются звонки.
+func (d forwardDestination) destination() string {
+	if d.DN != "" {
+		return d.DN
+	}
+	return d.To
+}
+
+// ForwardingInfo описывает состояние переадресации звонков и режима
+// "не беспокоить" для внутреннего номера пользователя.
+type ForwardingInfo struct {
+	DND      bool                       `json:"dnd"`
+	Forwards map[string]*ForwardingRule `json:"forwarding"`
+}
+
+// Forwarding возвращает информацию о настройках переадресации и режиме
+// "не беспокоить" для указанного внутреннего номера.
+func (m *MXServer) Forwarding(ext string) (*ForwardingInfo, error) {
+	resp, err := m.conn.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"GetForwarding"`
+		Device  string   `xml:"device"`
+	}{
+		Device: ext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var forwarding = new(struct {
+		List []struct {
+			Type   string `xml:"forwardingType"`
+			Status bool   `xml:"forwardStatus"`
+			forwardDestination
+		} `xml:"forwardingList>forwardListItem"`
+	})
+	if err = resp.Decode(forwarding); err != nil {
+		return nil, err
+	}
+	var info = &ForwardingInfo{
+		Forwards: make(map[string]*ForwardingRule, len(forwardingTypes)),
+	}
+	for name := range forwardingTypes {
+		info.Forwards[name] = new(ForwardingRule)
+	}
+	for _, item := range forwarding.List {
+		for name, cstaType := range forwardingTypes {
+			if item.Type == cstaType {
+				info.Forwards[name] = &ForwardingRule{
+					Enabled:     item.Status,
+					Destination: item.destination(),
+				}
+				break
+			}
+		}
+	}
+	resp, err = m.conn.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"GetDoNotDisturb"`
+		Device  string   `xml:"device"`
+	}{
+		Device: ext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var dnd = new(struct {
+		On bool `xml:"doNotDisturbOn"`
+	})
+	if err = resp.Decode(dnd); err != nil {
+		return nil, err
+	}
+	info.DND = dnd.On
+	return info, nil
+}
+
+// SetForwarding включает или выключает переадресацию звонков указанного типа.
+// Тип переадресации задается в виде названия, используемого в API: always,
+// busy или noAnswer.
+func (m *MXServer) SetForwarding(ext, name string, enabled bool, destination string) error {
+	cstaType, ok := forwardingTypes[name]
+	if !ok {
+		return fmt.Errorf("unknown forwarding type %q", name)
+	}
+	_, err := m.conn.SendWithResponse(&struct {
+		XMLName     xml.Name `xml:"SetForwarding"`
+		Device      string   `xml:"device"`
+		Type        string   `xml:"forwardingType"`
+		Status      bool     `xml:"activateForward"`
+		Destination string   `xml:"forwardDN,omitempty"`
+	}{
+		Device:      ext,
+		Type:        cstaType,
+		Status:      enabled,
+		Destination: destination,
+	})
+	return err
+}
+
+// SetDoNotDisturb включает или выключает режим "не беспокоить".
+func (m *MXServer) SetDoNotDisturb(ext string, enabled bool) error {
+	_, err := m.conn.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"SetDoNotDisturb"`
+		Device  string   `xml:"device"`
+		On      bool     `xml:"doNotDisturbOn"`
+	}{
+		Device: ext,
+		On:     enabled,
+	})
+	return err
+}
+
 // monitoring запускает процесс мониторинга звонков.
 func (m *MXServer) monitoring() error {
 	// запускаем мониторинг изменений в адресной книге
@@ -227,6 +576,28 @@ func (m *MXServer) monitoring() error {
 			m.ab.Delete(update.JID)
 			log.Debug("contact deleted", "jid", update.JID)
 			return nil
+		case "MailIncomingEvent":
+			// новое голосовое сообщение
+			var mail = new(struct {
+				Ext  string     `xml:"ext,attr"`
+				Mail *VoiceMail `xml:"mail"`
+			})
+			if err := resp.Decode(mail); err != nil || mail.Mail == nil {
+				log.Error("mx event parse error", err, "event", resp.Name)
+				return nil
+			}
+			var mData = m.monitor(mail.Ext)
+			if mData == nil {
+				log.Debug("not monitored voicemail", "ext", mail.Ext)
+				return nil
+			}
+			mail.Mail.Date = time.Unix(mail.Mail.Received, 0).UTC()
+			mData.send("VoiceMailEvent", mail.Mail) // отсылаем данные
+			log.Info("monitoring event",
+				"event", resp.Name,
+				"ext", mData.Extension,
+				"monitors", mData.Connected())
+			return nil
 		}
 
 		// обрабатываем события о звонках
@@ -245,9 +616,11 @@ func (m *MXServer) monitoring() error {
 			return nil
 		}
 		var event interface{} // данные для отсылки информации о событии
+		var callID *int64     // идентификатор звонка для отслеживания активных звонков
+		var active bool       // звонок активен после события
 		switch resp.Name {
 		case "OriginatedEvent":
-			event = new(struct {
+			var e = new(struct {
 				CallID        int64  `xml:"originatedConnection>callID" json:"callId"`
 				DeviceID      string `xml:"originatedConnection>deviceID" json:"deviceId"`
 				CallingDevice string `xml:"callingDevice>deviceIdentifier" json:"callingDevice"`
@@ -256,8 +629,9 @@ func (m *MXServer) monitoring() error {
 				CallTypeFlags uint32 `xml:"callTypeFlags" json:"callTypeFlags,omitempty"`
 				CmdsAllowed   uint32 `xml:"cmdsAllowed" json:"cmdsAllowed,omitempty"`
 			})
+			event, callID, active = e, &e.CallID, true
 		case "DivertedEvent":
-			event = new(struct {
+			var e = new(struct {
 				CallID                int64  `xml:"connection>callID" json:"callId"`
 				DeviceID              string `xml:"connection>deviceID" json:"deviceId"`
 				DivertingDevice       string `xml:"divertingDevice>deviceIdentifier" json:"divertingDevice"`
@@ -267,8 +641,9 @@ func (m *MXServer) monitoring() error {
 				CallTypeFlags         uint32 `xml:"callTypeFlags" json:"callTypeFlags,omitempty"`
 				CmdsAllowed           uint32 `xml:"cmdsAllowed" json:"cmdsAllowed,omitempty"`
 			})
+			event, callID, active = e, &e.CallID, false
 		case "DeliveredEvent":
-			event = new(struct {
+			var e = new(struct {
 				CallID                int64  `xml:"connection>callID" json:"callId"`
 				DeviceID              string `xml:"connection>deviceID" json:"deviceId"`
 				GlobalCallID          string `xml:"connection>globalCallID" json:"globalCallId"`
@@ -286,8 +661,9 @@ func (m *MXServer) monitoring() error {
 					Value string `xml:",chardata" json:"value,omitempty"`
 				} `xml:"cad,omitempty" json:"cads,omitempty"`
 			})
+			event, callID, active = e, &e.CallID, true
 		case "EstablishedEvent":
-			event = new(struct {
+			var e = new(struct {
 				CallID                int64  `xml:"establishedConnection>callID" json:"callId"`
 				DeviceID              string `xml:"establishedConnection>deviceID" json:"deviceId"`
 				GlobalCallID          string `xml:"establishedConnection>globalCallID" json:"globalCallId"`
@@ -306,19 +682,66 @@ func (m *MXServer) monitoring() error {
 					Value string `xml:",chardata" json:"value,omitempty"`
 				} `xml:"cad,omitempty" json:"cads,omitempty"`
 			})
+			event, callID, active = e, &e.CallID, true
 		case "ConnectionClearedEvent":
-			event = new(struct {
+			var e = new(struct {
 				CallID          int64  `xml:"droppedConnection>callID" json:"callId"`
 				DeviceID        string `xml:"droppedConnection>deviceID" json:"deviceId"`
 				ReleasingDevice string `xml:"releasingDevice>deviceIdentifier" json:"releasingDevice"`
 				Cause           string `xml:"cause" json:"cause"`
 			})
+			event, callID, active = e, &e.CallID, false
+		case "ForwardingEvent":
+			var forwarding = new(struct {
+				Device string `xml:"device>deviceIdentifier"`
+				Type   string `xml:"forwardingType"`
+				Status bool   `xml:"forwardStatus"`
+				forwardDestination
+			})
+			if err := resp.Decode(forwarding); err != nil {
+				log.Error("event decode error", err)
+				return nil
+			}
+			// приводим тип переадресации к названию, используемому в API
+			var name = forwarding.Type
+			for apiName, cstaType := range forwardingTypes {
+				if cstaType == forwarding.Type {
+					name = apiName
+					break
+				}
+			}
+			mData.send(resp.Name, &struct {
+				Device string `json:"device"`
+				Type   string `json:"type"`
+				*ForwardingRule
+			}{
+				Device: forwarding.Device,
+				Type:   name,
+				ForwardingRule: &ForwardingRule{
+					Enabled:     forwarding.Status,
+					Destination: forwarding.destination(),
+				},
+			})
+			log.Info("monitoring event",
+				"event", resp.Name,
+				"ext", mData.Extension,
+				"monitors", mData.Connected())
+			return nil
+		case "DoNotDisturbEvent":
+			event = new(struct {
+				Device string `xml:"device>deviceIdentifier" json:"device"`
+				On     bool   `xml:"doNotDisturbOn" json:"dnd"`
+			})
 		}
 		if err := resp.Decode(event); err != nil {
 			log.Error("event decode error", err)
 			return nil
 		}
-		mData.Event("", resp.Name, event) // отсылаем данные
+		// отслеживаем активные звонки пользователя
+		if callID != nil {
+			mData.trackCall(*callID, active)
+		}
+		mData.send(resp.Name, event) // отсылаем данные
 		log.Info("monitoring event",
 			"event", resp.Name,
 			"ext", mData.Extension,
@@ -326,7 +749,8 @@ func (m *MXServer) monitoring() error {
 		return nil
 	}, "AbUpdateUserEvent", "AbAddUserEvent", "AbDeleteUserEvent",
 		"OriginatedEvent", "DivertedEvent", "DeliveredEvent",
-		"EstablishedEvent", "ConnectionClearedEvent")
+		"EstablishedEvent", "ConnectionClearedEvent",
+		"ForwardingEvent", "DoNotDisturbEvent", "MailIncomingEvent")
 }
 
 // ConnectionInfo возвращает информацию о мониторинге и количестве подключений
@@ -344,6 +768,55 @@ func (m *MXServer) ConnectionInfo() map[string]int {
 	return result
 }
 
+// MonitorStatus описывает состояние запущенного монитора.
+type MonitorStatus struct {
+	Ext       string     `json:"ext"`                 // внутренний номер
+	Clients   int        `json:"clients"`             // подключенные клиенты SSE
+	Watchers  int        `json:"watchers"`            // подписанные супервизоры
+	Calls     int        `json:"calls"`               // активные звонки
+	LastEvent *time.Time `json:"lastEvent,omitempty"` // время последнего события
+}
+
+// Monitors возвращает состояние запущенных мониторов, отсортированное по
+// внутреннему номеру.
+func (m *MXServer) Monitors() []*MonitorStatus {
+	var result = make([]*MonitorStatus, 0)
+	m.monitors.Range(func(_, data interface{}) bool {
+		var md = data.(*monitorData)
+		var status = &MonitorStatus{
+			Ext:     md.Extension,
+			Clients: md.Connected(),
+		}
+		md.watchers.Range(func(_, _ interface{}) bool {
+			status.Watchers++
+			return true
+		})
+		md.mu.Lock()
+		status.Calls = len(md.calls)
+		if !md.lastEvent.IsZero() {
+			var lastEvent = md.lastEvent.UTC()
+			status.LastEvent = &lastEvent
+		}
+		md.mu.Unlock()
+		result = append(result, status)
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Ext < result[j].Ext
+	})
+	return result
+}
+
+// ContactsCount возвращает количество контактов в серверной адресной книге.
+func (m *MXServer) ContactsCount() int {
+	var count int
+	m.ab.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
 // Contacts возвращает список контактов.
 func (m *MXServer) Contacts() []*mx.Contact {
 	var list []*mx.Contact
@@ -357,6 +830,40 @@ func (m *MXServer) Contacts() []*mx.Contact {
 	return list
 }
 
+// ResyncAddressbook заново загружает серверную адресную книгу с сервера MX и
+// заменяет ей сохраненные контакты. Возвращает количество загруженных
+// контактов.
+func (m *MXServer) ResyncAddressbook() (int, error) {
+	contacts, err := m.conn.Addressbook()
+	if err != nil {
+		return 0, err
+	}
+	var loaded = make(map[mx.JID]bool, len(contacts))
+	for _, contact := range contacts {
+		m.ab.Store(contact.JID, contact)
+		loaded[contact.JID] = true
+	}
+	// удаляем контакты, которых больше нет на сервере
+	m.ab.Range(func(jid, _ interface{}) bool {
+		if !loaded[jid.(mx.JID)] {
+			m.ab.Delete(jid)
+		}
+		return true
+	})
+	m.mu.Lock()
+	m.abLoaded = time.Now()
+	m.mu.Unlock()
+	return len(contacts), nil
+}
+
+// AddressbookLoaded возвращает время последней загрузки серверной адресной
+// книги.
+func (m *MXServer) AddressbookLoaded() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.abLoaded
+}
+
 // // CallHold подвешивает звонок.
 // func (m *MXServer) CallHold(callID uint64, deviceID string) error {
 // 	var cmd = &struct {
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// configFields содержит имена полей конфигурации, которые могут быть заданы
+// в административном интерфейсе, а так же переопределены через переменные
+// окружения и параметры приложения. Дополнительные параметры задаются с
+// префиксом "params.".
+var configFields = []string{
+	"server.host",
+	"server.log",
+	"server.loginAttempts",
+	"server.loginLockout",
+	"server.loginMaxLockout",
+	"server.rateLimit",
+	"server.callQuota",
+	"mx.host",
+	"mx.login",
+	"mx.password",
+	"mx.sessions",
+	"roles.users",
+	"roles.groups",
+}
+
+// secretFields содержит имена секретных полей конфигурации. Для них не
+// создаются параметры приложения, поскольку параметры видны другим
+// пользователям системы в списке процессов: секреты переопределяются только
+// через переменные окружения.
+var secretFields = map[string]bool{
+	"mx.password": true,
+}
+
+// errUnknownField возвращается при попытке изменить неизвестное поле
+// конфигурации.
+var errUnknownField = errors.New("unknown config field")
+
+// intField возвращает ссылку на числовое поле конфигурации.
+func (c *Config) intField(name string) *int {
+	switch name {
+	case "server.loginAttempts":
+		return &c.Server.LoginAttempts
+	case "server.loginLockout":
+		return &c.Server.LoginLockout
+	case "server.loginMaxLockout":
+		return &c.Server.LoginMaxLockout
+	case "server.rateLimit":
+		return &c.Server.RateLimit
+	case "server.callQuota":
+		return &c.Server.CallQuota
+	}
+	return nil
+}
+
+// field возвращает строковое значение поля конфигурации с указанным именем.
+// Должна вызываться с блокировкой конфигурации.
+func (c *Config) field(name string) string {
+	if number := c.intField(name); number != nil {
+		return strconv.Itoa(*number)
+	}
+	switch name {
+	case "server.host":
+		return c.Server.Host
+	case "server.log":
+		return logLevelName(c.Server.LogLevel)
+	case "mx.host":
+		return c.MX.Host
+	case "mx.login":
+		return c.MX.Login
+	case "mx.password":
+		return string(c.MX.Password)
+	case "mx.sessions":
+		if c.MX.UserSessions {
+			return "USER"
+		}
+		return "SERVER"
+	case "roles.users":
+		return rolesText(c.Roles.Users)
+	case "roles.groups":
+		return rolesText(c.Roles.Groups)
+	}
+	if strings.HasPrefix(name, "params.") {
+		if raw, ok := c.Params[strings.TrimPrefix(name, "params.")]; ok {
+			return paramText(raw)
+		}
+	}
+	return ""
+}
+
+// checkField проверяет строковое значение поля конфигурации.
+func checkField(name, value string) error {
+	switch name {
+	case "server.loginAttempts", "server.loginLockout",
+		"server.loginMaxLockout", "server.rateLimit", "server.callQuota":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		// отрицательное значение отключает ограничение, а для квоты
+		// звонков это делает и ноль
+		if (n == 0 && name != "server.callQuota") ||
+			(n < 0 && (name == "server.loginLockout" ||
+				name == "server.loginMaxLockout")) {
+			return errors.New("bad " + name + " value")
+		}
+	case "server.host":
+		return checkHost(name, value, false)
+	case "mx.host":
+		return checkHost(name, value, true)
+	case "mx.login", "mx.password":
+		if value == "" {
+			return errors.New(name + " is empty")
+		}
+	case "server.log":
+		if value != "ALL" && value != "INFO" && value != "ERROR" {
+			return errors.New("bad log level")
+		}
+	case "mx.sessions":
+		if value != "USER" && value != "SERVER" {
+			return errors.New("bad mx sessions mode")
+		}
+	case "roles.users", "roles.groups":
+	default:
+		if !strings.HasPrefix(name, "params.") || name == "params." {
+			return errUnknownField
+		}
+	}
+	return nil
+}
+
+// assignField устанавливает значение поля конфигурации без проверки.
+// Должна вызываться с блокировкой конфигурации.
+func (c *Config) assignField(name, value string) {
+	if number := c.intField(name); number != nil {
+		*number, _ = strconv.Atoi(value)
+		return
+	}
+	switch name {
+	case "server.host":
+		c.Server.Host = value
+	case "server.log":
+		switch value {
+		case "ALL":
+			c.Server.LogLevel = -1
+		case "ERROR":
+			c.Server.LogLevel = 1
+		default:
+			c.Server.LogLevel = 0
+		}
+	case "mx.host":
+		c.MX.Host = value
+	case "mx.login":
+		c.MX.Login = value
+	case "mx.password":
+		c.MX.Password = Secret(value)
+	case "mx.sessions":
+		c.MX.UserSessions = value == "USER"
+	case "roles.users":
+		c.Roles.Users = parseRoles(value)
+	case "roles.groups":
+		c.Roles.Groups = parseRoles(value)
+	default:
+		c.assignParam(strings.TrimPrefix(name, "params."), value)
+	}
+}
+
+// setField проверяет и устанавливает новое значение поля конфигурации,
+// заданное в виде строки. Возвращает true, если значение изменилось.
+// Должна вызываться с блокировкой конфигурации.
+func (c *Config) setField(name, value string) (bool, error) {
+	if err := checkField(name, value); err != nil {
+		return false, err
+	}
+	var oldValue = c.field(name)
+	c.assignField(name, value)
+	return oldValue != c.field(name), nil
+}
+
+// envName возвращает имя переменной окружения для переопределения поля
+// конфигурации: "server.loginAttempts" — MXFLEX_SERVER_LOGIN_ATTEMPTS.
+// Имена дополнительных параметров не изменяются: "params.phoneCountry" —
+// MXFLEX_PARAM_phoneCountry.
+func envName(name string) string {
+	var prefix = strings.ToUpper(appName) + "_"
+	if strings.HasPrefix(name, "params.") {
+		return prefix + "PARAM_" + strings.TrimPrefix(name, "params.")
+	}
+	var buf = []rune(prefix)
+	for _, r := range name {
+		switch {
+		case r == '.':
+			buf = append(buf, '_')
+		case unicode.IsUpper(r):
+			buf = append(buf, '_', r)
+		default:
+			buf = append(buf, unicode.ToUpper(r))
+		}
+	}
+	return string(buf)
+}
+
+// paramFlags используется для задания дополнительных параметров в виде
+// повторяющихся параметров приложения "-param key=value".
+type paramFlags map[string]string
+
+func (p paramFlags) String() string {
+	var list = make([]string, 0, len(p))
+	for key, value := range p {
+		list = append(list, key+"="+value)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func (p paramFlags) Set(value string) error {
+	var indx = strings.IndexByte(value, '=')
+	if indx < 1 {
+		return errors.New("param must be in key=value format")
+	}
+	p[value[:indx]] = value[indx+1:]
+	return nil
+}
+
+// переопределения конфигурации, заданные параметрами приложения
+var (
+	overrideFlags  = make(map[string]*string)
+	overrideParams = make(paramFlags)
+)
+
+// defineOverrideFlags регистрирует параметры приложения для
+// переопределения полей конфигурации.
+func defineOverrideFlags() {
+	for _, name := range configFields {
+		if secretFields[name] {
+			continue
+		}
+		overrideFlags[name] = flag.String(name, "",
+			"override config `value` (env "+envName(name)+")")
+	}
+	flag.Var(overrideParams, "param",
+		"override config param as `key=value` (env "+envName("params.key")+")")
+}
+
+// ConfigOverrides возвращает значения полей конфигурации, переопределенные
+// через переменные окружения и параметры приложения. Параметры приложения
+// имеют приоритет над переменными окружения, а те — над конфигурационным
+// файлом.
+func ConfigOverrides() map[string]string {
+	var overrides = make(map[string]string)
+	for _, name := range configFields {
+		if value, ok := os.LookupEnv(envName(name)); ok && value != "" {
+			overrides[name] = value
+		}
+	}
+	var prefix = envName("params.")
+	for _, env := range os.Environ() {
+		var indx = strings.IndexByte(env, '=')
+		if indx > len(prefix) && strings.HasPrefix(env, prefix) {
+			overrides["params."+env[len(prefix):indx]] = env[indx+1:]
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if _, ok := overrideFlags[f.Name]; ok {
+			overrides[f.Name] = f.Value.String()
+		}
+	})
+	for key, value := range overrideParams {
+		overrides["params."+key] = value
+	}
+	// роли в переменных окружения и параметрах задаются через ";"
+	for _, name := range []string{"roles.users", "roles.groups"} {
+		if value, ok := overrides[name]; ok {
+			overrides[name] = strings.Replace(value, ";", "\n", -1)
+		}
+	}
+	return overrides
+}
+
+// applyOverrides устанавливает переопределенные значения полей
+// конфигурации, сохраняя значения из файла для последующей записи.
+// Должна вызываться с блокировкой конфигурации.
+func (c *Config) applyOverrides(overrides map[string]string) error {
+	c.overrides = make(map[string]string, len(overrides))
+	c.fileValues = make(map[string]*string, len(overrides))
+	for name, value := range overrides {
+		if err := checkField(name, value); err != nil {
+			return errors.New(name + ": " + err.Error())
+		}
+		var original *string // nil — параметр отсутствует в файле
+		if key := strings.TrimPrefix(name, "params."); key == name {
+			var value = c.field(name)
+			original = &value
+		} else if raw, ok := c.Params[key]; ok {
+			var value = string(raw) // значение параметра сохраняется в JSON
+			original = &value
+		}
+		c.fileValues[name] = original
+		c.overrides[name] = value
+		c.assignField(name, value)
+	}
+	return nil
+}
+
+// Overridden возвращает true, если поле конфигурации переопределено через
+// переменную окружения или параметр приложения и не может быть изменено в
+// административном интерфейсе.
+func (c *Config) Overridden(name string) bool {
+	_, ok := c.overrides[name]
+	return ok
+}
+
+// restoreFileValues временно возвращает значения переопределенных полей из
+// конфигурационного файла, чтобы переопределенные значения не записывались в
+// файл при сохранении. Возвращает функцию для восстановления
+// переопределенных значений. Должна вызываться с блокировкой конфигурации.
+func (c *Config) restoreFileValues() func() {
+	for name, value := range c.fileValues {
+		var key = strings.TrimPrefix(name, "params.")
+		switch {
+		case key == name:
+			c.assignField(name, *value)
+		case value != nil:
+			c.Params[key] = json.RawMessage(*value)
+		default:
+			delete(c.Params, key)
+		}
+	}
+	return func() {
+		for name, value := range c.overrides {
+			c.assignField(name, value)
+		}
+	}
+}
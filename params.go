@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mdigger/rest"
+)
+
+// типы значений дополнительных параметров
+const (
+	paramString = "string"
+	paramNumber = "number"
+	paramBool   = "bool"
+	paramJSON   = "json"
+)
+
+// paramType возвращает тип значения дополнительного параметра, определяя его
+// по представлению в JSON.
+func paramType(raw json.RawMessage) string {
+	var value = bytes.TrimSpace(raw)
+	if len(value) == 0 {
+		return paramString
+	}
+	switch c := value[0]; {
+	case c == '"':
+		return paramString
+	case c == 't' || c == 'f':
+		return paramBool
+	case c == '-' || (c >= '0' && c <= '9'):
+		return paramNumber
+	}
+	return paramJSON
+}
+
+// paramText возвращает текстовое представление значения дополнительного
+// параметра: строки возвращаются без кавычек, а остальные значения — в виде
+// JSON.
+func paramText(raw json.RawMessage) string {
+	if paramType(raw) == paramString {
+		var text string
+		if json.Unmarshal(raw, &text) == nil {
+			return text
+		}
+	}
+	return string(raw)
+}
+
+// parseParam разбирает текстовое значение дополнительного параметра
+// указанного типа и возвращает его представление в JSON.
+func parseParam(typ, text string) (json.RawMessage, error) {
+	switch typ {
+	case paramString, "":
+		return json.Marshal(text)
+	case paramNumber:
+		text = strings.TrimSpace(text)
+		if !json.Valid([]byte(text)) || paramType([]byte(text)) != paramNumber {
+			return nil, errors.New("bad number: " + text)
+		}
+		return json.RawMessage(text), nil
+	case paramBool:
+		value, err := strconv.ParseBool(strings.TrimSpace(text))
+		if err != nil {
+			return nil, errors.New("bad bool: " + text)
+		}
+		return json.Marshal(value)
+	case paramJSON:
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, []byte(text)); err != nil {
+			return nil, errors.New("bad json: " + err.Error())
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errors.New("bad param type: " + typ)
+}
+
+// paramValue возвращает значение дополнительного параметра, переданное в
+// JSON API. Если тип не указан, то он определяется по значению, а строковое
+// значение для другого типа разбирается как текст.
+func paramValue(typ string, value json.RawMessage) (json.RawMessage, error) {
+	value = bytes.TrimSpace(value)
+	switch {
+	case len(value) == 0:
+		return nil, errors.New("param value required")
+	case typ != "" && typ != paramString && typ != paramNumber &&
+		typ != paramBool && typ != paramJSON:
+		return nil, errors.New("bad param type: " + typ)
+	}
+	var actual = paramType(value)
+	if typ == "" || typ == actual || typ == paramJSON {
+		return parseParam(paramJSON, string(value))
+	}
+	if actual == paramString {
+		var text string
+		if err := json.Unmarshal(value, &text); err != nil {
+			return nil, err
+		}
+		return parseParam(typ, text)
+	}
+	return nil, errors.New("bad " + typ + " value")
+}
+
+// compactParams удаляет из значений дополнительных параметров лишние
+// пробелы, чтобы значения, загруженные из файла, можно было сравнивать.
+func compactParams(params map[string]json.RawMessage) {
+	for key, raw := range params {
+		var buf bytes.Buffer
+		if json.Compact(&buf, raw) == nil {
+			params[key] = buf.Bytes()
+		}
+	}
+}
+
+// assignParam устанавливает текстовое значение дополнительного параметра.
+// Значение приводится к типу текущего значения параметра, а если это
+// невозможно или параметра нет, то сохраняется как строка. Должна
+// вызываться с блокировкой конфигурации.
+func (c *Config) assignParam(key, text string) {
+	if c.Params == nil {
+		c.Params = make(map[string]json.RawMessage)
+	}
+	if raw, ok := c.Params[key]; ok {
+		if value, err := parseParam(paramType(raw), text); err == nil {
+			c.Params[key] = value
+			return
+		}
+	}
+	c.Params[key], _ = parseParam(paramString, text)
+}
+
+// области действия дополнительных параметров: глобальные параметры
+// задаются без префикса
+const (
+	scopeGroupPrefix = "group:" // параметры группы MX
+	scopeExtPrefix   = "ext:"   // параметры внутреннего номера
+)
+
+// paramsScope возвращает дополнительные параметры для области действия:
+// "" — глобальные, "group:имя" — группы MX, "ext:номер" — внутреннего
+// номера. Если create установлен, то отсутствующая область создается.
+// Должна вызываться с блокировкой конфигурации.
+func (c *Config) paramsScope(scope string, create bool) (map[string]json.RawMessage, error) {
+	var scopes *map[string]map[string]json.RawMessage
+	var name string
+	switch {
+	case scope == "":
+		if c.Params == nil && create {
+			c.Params = make(map[string]json.RawMessage)
+		}
+		return c.Params, nil
+	case strings.HasPrefix(scope, scopeGroupPrefix):
+		scopes, name = &c.GroupParams, strings.TrimPrefix(scope, scopeGroupPrefix)
+	case strings.HasPrefix(scope, scopeExtPrefix):
+		scopes, name = &c.ExtParams, strings.TrimPrefix(scope, scopeExtPrefix)
+	}
+	if scopes == nil || strings.TrimSpace(name) != name || name == "" {
+		return nil, errors.New("bad params scope: " + scope)
+	}
+	var params = (*scopes)[name]
+	if params == nil && create {
+		if *scopes == nil {
+			*scopes = make(map[string]map[string]json.RawMessage)
+		}
+		params = make(map[string]json.RawMessage)
+		(*scopes)[name] = params
+	}
+	return params, nil
+}
+
+// paramOverridden возвращает true, если параметр переопределен. Переопределены
+// могут быть только глобальные параметры.
+func (c *Config) paramOverridden(scope, key string) bool {
+	return scope == "" && c.Overridden("params."+key)
+}
+
+// setParam проверяет и устанавливает значение дополнительного параметра
+// указанного типа в области действия. Должна вызываться с блокировкой
+// конфигурации.
+func (c *Config) setParam(scope, key, typ, text string) error {
+	if err := checkField("params."+key, text); err != nil {
+		return err
+	}
+	value, err := parseParam(typ, text)
+	if err != nil {
+		return errors.New("params." + key + ": " + err.Error())
+	}
+	params, err := c.paramsScope(scope, true)
+	if err != nil {
+		return err
+	}
+	params[key] = value
+	return nil
+}
+
+// deleteParam удаляет дополнительный параметр из области действия. Пустые
+// области групп и внутренних номеров удаляются. Возвращает false, если
+// параметр не найден. Должна вызываться с блокировкой конфигурации.
+func (c *Config) deleteParam(scope, key string) bool {
+	params, err := c.paramsScope(scope, false)
+	if err != nil {
+		return false
+	}
+	if _, ok := params[key]; !ok {
+		return false
+	}
+	delete(params, key)
+	if len(params) > 0 {
+		return true
+	}
+	switch {
+	case strings.HasPrefix(scope, scopeGroupPrefix):
+		delete(c.GroupParams, strings.TrimPrefix(scope, scopeGroupPrefix))
+	case strings.HasPrefix(scope, scopeExtPrefix):
+		delete(c.ExtParams, strings.TrimPrefix(scope, scopeExtPrefix))
+	}
+	return true
+}
+
+// paramScopes возвращает список всех областей действия дополнительных
+// параметров: глобальную, затем группы и внутренние номера по порядку.
+// Должна вызываться с блокировкой конфигурации.
+func (c *Config) paramScopes() []string {
+	var groups = make([]string, 0, len(c.GroupParams))
+	for name := range c.GroupParams {
+		groups = append(groups, scopeGroupPrefix+name)
+	}
+	sort.Strings(groups)
+	var exts = make([]string, 0, len(c.ExtParams))
+	for ext := range c.ExtParams {
+		exts = append(exts, scopeExtPrefix+ext)
+	}
+	sort.Strings(exts)
+	return append(append([]string{""}, groups...), exts...)
+}
+
+// copyParams возвращает копию дополнительных параметров.
+func copyParams(params map[string]json.RawMessage) map[string]json.RawMessage {
+	if params == nil {
+		return nil
+	}
+	var result = make(map[string]json.RawMessage, len(params))
+	for key, value := range params {
+		result[key] = value
+	}
+	return result
+}
+
+// copyScopes возвращает копию дополнительных параметров групп или
+// внутренних номеров.
+func copyScopes(scopes map[string]map[string]json.RawMessage) map[string]map[string]json.RawMessage {
+	if scopes == nil {
+		return nil
+	}
+	var result = make(map[string]map[string]json.RawMessage, len(scopes))
+	for name, params := range scopes {
+		result[name] = copyParams(params)
+	}
+	return result
+}
+
+// rules возвращает дополнительные параметры для пользователя: глобальные
+// параметры дополняются и заменяются параметрами групп, в которые входит
+// пользователь (по порядку названий групп), а затем параметрами его
+// внутреннего номера. Должна вызываться с блокировкой конфигурации.
+func (c *Config) rules(ext string, groups []string) map[string]json.RawMessage {
+	var result = copyParams(c.Params)
+	if result == nil {
+		result = make(map[string]json.RawMessage)
+	}
+	var scoped = make([]map[string]json.RawMessage, 0, len(groups)+1)
+	for _, group := range groups {
+		scoped = append(scoped, c.GroupParams[group])
+	}
+	scoped = append(scoped, c.ExtParams[ext])
+	for _, params := range scoped {
+		for key, value := range params {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// Rules отдает дополнительные параметры. Без авторизации отдаются только
+// глобальные параметры, а авторизованному пользователю — объединенные с
+// параметрами его групп MX и внутреннего номера. Если получить список групп
+// с сервера MX не удалось, то параметры групп не используются. Для
+// авторизованных запросов действует ограничение частоты запросов к API.
+func (h *HTTPHandler) Rules(c *rest.Context) error {
+	var config = h.config
+	if c.Header("Authorization") == "" && c.Header("X-API-Key") == "" &&
+		c.Request.FormValue("access_token") == "" {
+		config.mu.RLock()
+		defer config.mu.RUnlock()
+		return c.Write(rest.JSON{"params": config.Params})
+	}
+	token, err := h.tokenInfo(c)
+	if err != nil {
+		return err
+	}
+	if err := rateLimit(c, h.rateLimiter, token.Subject()+" GET /rules"); err != nil {
+		return err
+	}
+	var groups []string
+	config.mu.RLock()
+	var groupParams = len(config.GroupParams) > 0
+	config.mu.RUnlock()
+	if groupParams && token.Ext != "" {
+		if groups, err = h.userGroups(token.Ext); err != nil {
+			// отдаем глобальные параметры и параметры внутреннего номера
+			c.AddLogField("groupsError", err.Error())
+			groups = nil
+		}
+	}
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+	return c.Write(rest.JSON{"params": config.rules(token.Ext, groups)})
+}
+
+// ParamItem описывает дополнительный параметр для отображения в
+// административном интерфейсе.
+type ParamItem struct {
+	Scope      string // область действия параметра
+	Key        string // имя параметра
+	Type       string // тип значения
+	Value      string // текстовое представление значения
+	Overridden bool   // значение переопределено и не может быть изменено
+}
+
+// ParamList возвращает список дополнительных параметров всех областей
+// действия, отсортированный по области и имени.
+func (c *Config) ParamList() []*ParamItem {
+	var list []*ParamItem
+	for _, scope := range c.paramScopes() {
+		var params, _ = c.paramsScope(scope, false)
+		var keys = make([]string, 0, len(params))
+		for key := range params {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			list = append(list, &ParamItem{
+				Scope:      scope,
+				Key:        key,
+				Type:       paramType(params[key]),
+				Value:      paramText(params[key]),
+				Overridden: c.paramOverridden(scope, key),
+			})
+		}
+	}
+	return list
+}
+
+// Params добавляет, изменяет, переименовывает и удаляет дополнительные
+// параметры.
+func (a *Admin) Params(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		status := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var (
+		action = r.PostForm.Get("action")
+		scope  = strings.TrimSpace(r.PostForm.Get("scope"))
+		old    = strings.TrimSpace(r.PostForm.Get("old")) // имя до изменения
+		key    = strings.TrimSpace(r.PostForm.Get("key"))
+		typ    = r.PostForm.Get("type")
+		value  = r.PostForm.Get("value")
+	)
+	if typ != paramJSON {
+		value = strings.TrimSpace(value)
+	}
+	config, errs, err := a.changeConfig(r, false, func(config *Config) []string {
+		if config.paramOverridden(scope, old) || config.paramOverridden(scope, key) {
+			return []string{"param is overridden"}
+		}
+		params, err := config.paramsScope(scope, false)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		switch action {
+		case "delete":
+			if !config.deleteParam(scope, old) {
+				return []string{"param not found"}
+			}
+		case "save":
+			if key == "" {
+				return []string{"param name required"}
+			}
+			if key != old {
+				if _, ok := params[key]; ok {
+					return []string{"param " + key + " already exists"}
+				}
+			}
+			if err := config.setParam(scope, key, typ, value); err != nil {
+				return []string{err.Error()}
+			}
+			// переименование параметра
+			if old != "" && old != key {
+				config.deleteParam(scope, old)
+			}
+		default:
+			return []string{"unknown action"}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(errs) > 0 {
+		a.configPage(w, r, http.StatusBadRequest, config, strings.Join(errs, "; "))
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParamType(t *testing.T) {
+	var tests = []struct {
+		raw, typ string
+	}{
+		{`"EE"`, paramString},
+		{` "EE" `, paramString},
+		{``, paramString},
+		{`5`, paramNumber},
+		{`-1.5`, paramNumber},
+		{`true`, paramBool},
+		{`false`, paramBool},
+		{`{"a":1}`, paramJSON},
+		{`[1,2]`, paramJSON},
+		{`null`, paramJSON},
+	}
+	for _, test := range tests {
+		if typ := paramType(json.RawMessage(test.raw)); typ != test.typ {
+			t.Errorf("paramType(%s) = %q, want %q", test.raw, typ, test.typ)
+		}
+	}
+}
+
+func TestParseParam(t *testing.T) {
+	var tests = []struct {
+		typ, text string
+		want      string // пустое значение — ошибка
+	}{
+		{paramString, "EE", `"EE"`},
+		{"", "EE", `"EE"`},
+		{paramString, `say "hi"`, `"say \"hi\""`},
+		{paramNumber, " 5 ", `5`},
+		{paramNumber, "-1.5e3", `-1.5e3`},
+		{paramNumber, "five", ""},
+		{paramNumber, "true", ""},
+		{paramNumber, "05", ""},
+		{paramBool, "true", `true`},
+		{paramBool, " 0 ", `false`},
+		{paramBool, "yes", ""},
+		{paramJSON, `{"a": [1, 2]}`, `{"a":[1,2]}`},
+		{paramJSON, `{"a":`, ""},
+		{"xml", "<a/>", ""},
+	}
+	for _, test := range tests {
+		value, err := parseParam(test.typ, test.text)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("parseParam(%q, %q) = %s, want error", test.typ,
+				test.text, value)
+		case test.want != "" && err != nil:
+			t.Errorf("parseParam(%q, %q) error: %v", test.typ, test.text, err)
+		case test.want != "" && string(value) != test.want:
+			t.Errorf("parseParam(%q, %q) = %s, want %s", test.typ, test.text,
+				value, test.want)
+		}
+	}
+}
+
+func TestParamValue(t *testing.T) {
+	var tests = []struct {
+		typ, value string
+		want       string // пустое значение — ошибка
+	}{
+		{"", `"EE"`, `"EE"`},
+		{"", ` 5 `, `5`},
+		{"", `true`, `true`},
+		{"", `{"a": 1}`, `{"a":1}`},
+		{paramString, `"EE"`, `"EE"`},
+		{paramString, `5`, ""},
+		{paramNumber, `5`, `5`},
+		{paramNumber, `"5"`, `5`},
+		{paramNumber, `"1e3"`, `1e3`},
+		{paramNumber, `"five"`, ""},
+		{paramNumber, `true`, ""},
+		{paramBool, `false`, `false`},
+		{paramBool, `"true"`, `true`},
+		{paramBool, `1`, ""},
+		{paramJSON, `"EE"`, `"EE"`},
+		{paramJSON, `[1, 2]`, `[1,2]`},
+		{"xml", `1`, ""},
+		{"", ``, ""},
+		{"", `  `, ""},
+		{"", `{bad`, ""},
+	}
+	for _, test := range tests {
+		value, err := paramValue(test.typ, json.RawMessage(test.value))
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("paramValue(%q, %s) = %s, want error", test.typ,
+				test.value, value)
+		case test.want != "" && err != nil:
+			t.Errorf("paramValue(%q, %s) error: %v", test.typ, test.value, err)
+		case test.want != "" && string(value) != test.want:
+			t.Errorf("paramValue(%q, %s) = %s, want %s", test.typ, test.value,
+				value, test.want)
+		}
+	}
+}
+
+func TestConfigRules(t *testing.T) {
+	var config = &Config{
+		Params: map[string]json.RawMessage{
+			"a": json.RawMessage(`1`),
+			"b": json.RawMessage(`"global"`),
+			"c": json.RawMessage(`"global"`),
+		},
+		GroupParams: map[string]map[string]json.RawMessage{
+			"Riga": {
+				"b": json.RawMessage(`"riga"`),
+				"c": json.RawMessage(`"riga"`),
+			},
+			"Sales": {
+				"c": json.RawMessage(`"sales"`),
+				"d": json.RawMessage(`true`),
+			},
+		},
+		ExtParams: map[string]map[string]json.RawMessage{
+			"3095": {"c": json.RawMessage(`"ext"`)},
+		},
+	}
+	var tests = []struct {
+		name   string
+		ext    string
+		groups []string
+		want   string
+	}{
+		{"global", "3096", nil,
+			`{"a":1,"b":"global","c":"global"}`},
+		{"ext", "3095", nil,
+			`{"a":1,"b":"global","c":"ext"}`},
+		{"group", "3096", []string{"Riga"},
+			`{"a":1,"b":"riga","c":"riga"}`},
+		{"groups in order", "3096", []string{"Riga", "Sales"},
+			`{"a":1,"b":"riga","c":"sales","d":true}`},
+		{"ext over groups", "3095", []string{"Riga", "Sales"},
+			`{"a":1,"b":"riga","c":"ext","d":true}`},
+		{"unknown group", "3096", []string{"Tallinn"},
+			`{"a":1,"b":"global","c":"global"}`},
+		{"no ext", "", nil,
+			`{"a":1,"b":"global","c":"global"}`},
+	}
+	for _, test := range tests {
+		data, err := json.Marshal(config.rules(test.ext, test.groups))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.want {
+			t.Errorf("%s: rules() = %s, want %s", test.name, data, test.want)
+		}
+	}
+	// объединение параметров не должно изменять глобальные параметры
+	if len(config.Params) != 3 || string(config.Params["c"]) != `"global"` {
+		t.Errorf("global params changed: %s", config.Params)
+	}
+	// без глобальных параметров возвращается пустой объект
+	if rules := new(Config).rules("3095", nil); rules == nil || len(rules) != 0 {
+		t.Errorf("empty config rules() = %v, want empty map", rules)
+	}
+}
+
+func TestConfigParamsScope(t *testing.T) {
+	var tests = []struct {
+		scope string
+		ok    bool
+	}{
+		{"", true},
+		{"group:Sales", true},
+		{"ext:3095", true},
+		{"group:", false},
+		{"ext: 3095", false},
+		{"user:3095", false},
+		{"Sales", false},
+	}
+	for _, test := range tests {
+		var config = new(Config)
+		params, err := config.paramsScope(test.scope, true)
+		if (err == nil) != test.ok {
+			t.Errorf("paramsScope(%q) error %v, want ok %v", test.scope, err,
+				test.ok)
+			continue
+		}
+		if test.ok && params == nil {
+			t.Errorf("paramsScope(%q) did not create params", test.scope)
+		}
+	}
+}
+
+func TestConfigDeleteParam(t *testing.T) {
+	var newConfig = func() *Config {
+		return &Config{
+			Params: map[string]json.RawMessage{"a": json.RawMessage(`1`)},
+			GroupParams: map[string]map[string]json.RawMessage{
+				"3095": {"a": json.RawMessage(`2`)},
+			},
+			ExtParams: map[string]map[string]json.RawMessage{
+				"3095": {"a": json.RawMessage(`3`)},
+			},
+		}
+	}
+	// имя группы совпадает с внутренним номером: удаляется только
+	// опустевшая область, из которой удален параметр
+	var tests = []struct {
+		scope, key         string
+		ok                 bool
+		global, group, ext int // оставшихся областей и параметров
+	}{
+		{"", "a", true, 0, 1, 1},
+		{"group:3095", "a", true, 1, 0, 1},
+		{"ext:3095", "a", true, 1, 1, 0},
+		{"ext:3095", "b", false, 1, 1, 1},
+		{"ext:3096", "a", false, 1, 1, 1},
+		{"user:3095", "a", false, 1, 1, 1},
+	}
+	for _, test := range tests {
+		var config = newConfig()
+		if ok := config.deleteParam(test.scope, test.key); ok != test.ok {
+			t.Errorf("deleteParam(%q, %q) = %v, want %v", test.scope, test.key,
+				ok, test.ok)
+		}
+		if len(config.Params) != test.global ||
+			len(config.GroupParams) != test.group ||
+			len(config.ExtParams) != test.ext {
+			t.Errorf("deleteParam(%q, %q): %d global, %d group, %d ext params, want %d, %d, %d",
+				test.scope, test.key, len(config.Params), len(config.GroupParams),
+				len(config.ExtParams), test.global, test.group, test.ext)
+		}
+	}
+}
@@ -3,10 +3,11 @@ package main
 import (
 	"crypto/tls"
 	"errors"
+	"net"
 	"net/http"
-	"net/url"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mdigger/log"
@@ -17,7 +18,13 @@ import (
 // Proxy описывает основной HTTP сервер для работы с MX.
 type Proxy struct {
 	handler *HTTPHandler // обработчик API
-	server  *http.Server
+	mux     http.Handler // обработчик HTTP запросов
+	log     *log.Logger  // для вывода лога
+	server  *http.Server // HTTP сервер
+	host    string       // адрес сервиса запущенного HTTP сервера
+	acme    *http.Server // HTTP сервер для получения сертификата Let's Encrypt
+	err     error        // ошибка остановки HTTP сервера
+	mu      sync.RWMutex // блокировка одновременного доступа к серверу
 }
 
 // NewProxy запускает новый сервер.
@@ -32,6 +39,9 @@ func NewProxy(config *Config) (*Proxy, error) {
 	if err != nil {
 		return nil, err
 	}
+	handler.userSessions = config.MX.UserSessions
+	handler.config = config
+	handler.configureLimits(config)
 	slog := log.New("http")
 	// инициализируем обработку HTTP запросов
 	var mux = &rest.ServeMux{
@@ -47,27 +57,54 @@ func NewProxy(config *Config) (*Proxy, error) {
 	// обработчики API
 	mux.Handle("POST", "/api/login", handler.Login)
 	mux.Handle("GET", "/api/logout", handler.Logout)
-	mux.Handle("GET", "/api/contacts", handler.Contacts)
-	mux.Handle("POST", "/api/call", handler.MakeCall)
-	mux.Handle("POST", "/api/call/hangup", handler.CallHangup)
-	mux.Handle("POST", "/api/call/transfer", handler.CallTransfer)
-	mux.Handle("GET", "/api/events", handler.Events)
-	mux.Handle("GET", "/api/info", handler.ConnectionInfo)
+	// обработчики API с проверкой доступа и ограничением частоты запросов
+	var api = func(method, path, scope string, h rest.Handler) {
+		mux.Handle(method, path, handler.Access(method+" "+path, scope, h))
+	}
+	api("GET", "/api/contacts", scopeContacts, handler.Contacts)
+	api("POST", "/api/call", scopeCall, handler.MakeCall)
+	api("POST", "/api/call/hangup", scopeCall, handler.CallHangup)
+	api("POST", "/api/call/transfer", scopeCall, handler.CallTransfer)
+	api("GET", "/api/forwarding", scopeRead, handler.Forwarding)
+	api("POST", "/api/forwarding", scopeSettings, handler.SetForwarding)
+	api("POST", "/api/forwarding/dnd", scopeSettings, handler.SetDoNotDisturb)
+	api("GET", "/api/voicemail", scopeRead, handler.VoiceMails)
+	api("GET", "/api/voicemail/:id", scopeRead, handler.VoiceMail)
+	api("POST", "/api/voicemail/:id/read", scopeSettings, handler.VoiceMailRead)
+	api("DELETE", "/api/voicemail/:id", scopeSettings, handler.VoiceMailDelete)
+	api("GET", "/api/calllog", scopeRead, handler.CallLog)
+	api("GET", "/api/events", scopeRead, handler.Events)
+	api("GET", "/api/info", scopeSupervise, handler.ConnectionInfo)
+	mux.Handle("GET", "/healthz", handler.Healthz)
 	// дополнительные данные
-	mux.Handle("GET", "/rules", func(c *rest.Context) error {
-		config.mu.RLock()
-		defer config.mu.RUnlock()
-		return c.Write(rest.JSON{"params": config.Params})
-	})
+	mux.Handle("GET", "/rules", handler.Rules)
 
+	var proxy = &Proxy{handler: handler, mux: mux, log: slog}
+	mux.Handle("GET", "/readyz", proxy.Readyz)
+	if err := proxy.listen(config, hostURL(config.Server.Host)); err != nil {
+		handler.Close()
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// listen запускает HTTP сервер для указанного адреса сервиса. Адрес
+// занимается сразу, поэтому ошибка возвращается до запуска сервера. Должна
+// вызываться с блокировкой конфигурации.
+func (p *Proxy) listen(config *Config, host string) error {
 	// инициализируем HTTP сервер
 	var server = &http.Server{
-		Handler:     mux,
+		Addr:        listenAddr(host),
+		Handler:     p.mux,
 		ReadTimeout: time.Second * 10,
-		ErrorLog:    slog.StdLog(log.WARN),
+		ErrorLog:    p.log.StdLog(log.WARN),
+	}
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
 	}
-	if host := config.ServerURL(); strings.HasPrefix(host, "https://") {
-		server.Addr = ":https"
+	var acme *http.Server
+	if strings.HasPrefix(host, "https://") {
 		host := host[8:]
 		if indx := strings.IndexAny(host, ":/"); indx > 0 {
 			host = host[:indx]
@@ -82,33 +119,97 @@ func NewProxy(config *Config) (*Proxy, error) {
 			GetCertificate: manager.GetCertificate,
 		}
 		// поддержка получения сертификата Let's Encrypt
-		go http.ListenAndServe(":http", manager.HTTPHandler(nil))
-	} else {
-		server.Addr = ":http"
-		if hostURL, err := url.Parse(host); err == nil {
-			if port := hostURL.Port(); port != "" {
-				server.Addr = ":" + port
-			}
+		acme = &http.Server{
+			Addr:     ":http",
+			Handler:  manager.HTTPHandler(nil),
+			ErrorLog: p.log.StdLog(log.WARN),
 		}
 	}
+	// сервер сохраняется до запуска, чтобы ошибка его работы не была потеряна
+	p.mu.Lock()
+	var oldACME = p.acme
+	p.server, p.host, p.err, p.acme = server, host, nil, acme
+	p.mu.Unlock()
 	go func() {
-		slog.Info("service started", "addr", server.Addr)
+		p.log.Info("service started", "addr", server.Addr)
 		var err error
-		if server.Addr == ":https" {
-			err = server.ListenAndServeTLS("", "")
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(ln, "", "")
 		} else {
-			err = server.ListenAndServe()
+			err = server.Serve(ln)
+		}
+		p.log.Info("service stopped", err)
+		if err == http.ErrServerClosed {
+			return // сервер остановлен или перезапущен
+		}
+		p.mu.Lock()
+		if p.server == server {
+			p.err = err
 		}
-		slog.Info("service stopped", err)
+		p.mu.Unlock()
 		config.mu.Lock()
 		config.err = err
 		config.mu.Unlock()
 	}()
-	return &Proxy{handler: handler, server: server}, nil
+	// заменяем сервер для получения сертификата сервером с новыми
+	// параметрами
+	if oldACME != nil {
+		oldACME.Close()
+	}
+	if acme != nil {
+		go func() {
+			if err := acme.ListenAndServe(); err != http.ErrServerClosed {
+				p.log.Error("acme http server error", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// Addr возвращает адрес, на котором запущен HTTP сервер.
+func (p *Proxy) Addr() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.server.Addr
+}
+
+// Restart перезапускает HTTP сервер с новым адресом из конфигурации без
+// переподключения к серверу MX. Если новый адрес занять не удалось, то
+// продолжает работать текущий сервер.
+func (p *Proxy) Restart(config *Config) error {
+	p.mu.RLock()
+	var old, oldHost = p.server, p.host
+	p.mu.RUnlock()
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+	var host = hostURL(config.Server.Host)
+	if !sameListenAddr(old.Addr, listenAddr(host)) {
+		// новый адрес занимается до остановки текущего сервера
+		if err := p.listen(config, host); err != nil {
+			return err
+		}
+		old.Close()
+		return nil
+	}
+	// на том же адресе текущий сервер останавливается до запуска нового, а
+	// при ошибке запускается снова с прежними параметрами
+	old.Close()
+	var err = p.listen(config, host)
+	if err != nil {
+		if err := p.listen(config, oldHost); err != nil {
+			p.log.Error("server restore error", err)
+		}
+	}
+	return err
 }
 
 // Close закрывает соединение с сервером MX и останавливает сервер.
 func (p *Proxy) Close() error {
+	p.mu.RLock()
 	p.server.Close()
+	if p.acme != nil {
+		p.acme.Close()
+	}
+	p.mu.RUnlock()
 	return p.handler.Close()
 }
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+// securityLog используется для вывода в лог событий безопасности.
+var securityLog = log.New("security")
+
+// Ограничения API не зависят от обработчика HTTP-запросов, поэтому
+// блокировки и счетчики сохраняются при перезапуске сервиса, смене режима
+// соединений и перезагрузке конфигурации.
+var (
+	apiLoginLimiter = new(LoginLimiter)          // неудачные попытки авторизации
+	apiRateLimiter  = new(RateLimiter)           // частота запросов к API
+	apiCallQuota    = &RateLimiter{Window: true} // количество звонков
+)
+
+// LoginLimiter ограничивает количество неудачных попыток авторизации. После
+// указанного количества неудачных попыток авторизация блокируется. Время
+// блокировки удваивается при каждой следующей блокировке, пока не достигнет
+// максимального значения. Ключами обычно служат логин и IP-адрес клиента.
+type LoginLimiter struct {
+	Attempts   int           // количество неудачных попыток до блокировки
+	Lockout    time.Duration // время первой блокировки
+	MaxLockout time.Duration // максимальное время блокировки
+	failures   map[string]*loginFailures
+	swept      time.Time // время последнего удаления устаревших счетчиков
+	mu         sync.Mutex
+}
+
+// loginFailuresLimit ограничивает количество счетчиков неудачных попыток
+// авторизации, хранящихся в памяти.
+var loginFailuresLimit = 10000
+
+// loginFailures описывает количество неудачных попыток авторизации,
+// количество блокировок и время окончания текущей блокировки.
+type loginFailures struct {
+	count int
+	locks int
+	until time.Time
+	last  time.Time
+}
+
+// expired возвращает true, если после последней неудачной попытки прошло
+// больше времени, чем максимальное время блокировки, и блокировка не
+// действует. Такой счетчик больше не учитывается.
+func (f *loginFailures) expired(now time.Time, maxLockout time.Duration) bool {
+	return now.Sub(f.last) > maxLockout && now.After(f.until)
+}
+
+// Locked возвращает время, оставшееся до окончания блокировки, если
+// авторизация для любого из указанных ключей временно заблокирована.
+func (l *LoginLimiter) Locked(keys ...string) time.Duration {
+	var now = time.Now()
+	var locked time.Duration
+	l.mu.Lock()
+	for _, key := range keys {
+		if failures, ok := l.failures[key]; ok && now.Before(failures.until) {
+			if d := failures.until.Sub(now); d > locked {
+				locked = d
+			}
+		}
+	}
+	l.mu.Unlock()
+	return locked
+}
+
+// Failed увеличивает счетчики неудачных попыток авторизации для указанных
+// ключей и блокирует авторизацию при превышении их количества. Возвращает
+// время блокировки, если она была установлена.
+func (l *LoginLimiter) Failed(keys ...string) time.Duration {
+	var now = time.Now()
+	var locked time.Duration
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Attempts < 1 {
+		return 0 // ограничение отключено
+	}
+	if l.failures == nil {
+		l.failures = make(map[string]*loginFailures)
+	}
+	// удаляем устаревшие счетчики не чаще раза в минуту
+	if now.Sub(l.swept) > time.Minute {
+		for key, failures := range l.failures {
+			if failures.expired(now, l.MaxLockout) {
+				delete(l.failures, key)
+			}
+		}
+		l.swept = now
+	}
+	for _, key := range keys {
+		var failures, ok = l.failures[key]
+		if !ok {
+			if len(l.failures) >= loginFailuresLimit {
+				l.evict()
+			}
+			failures = new(loginFailures)
+			l.failures[key] = failures
+		} else if failures.expired(now, l.MaxLockout) {
+			*failures = loginFailures{} // счетчик истек
+		}
+		failures.last = now
+		failures.count++
+		if failures.count < l.Attempts {
+			continue
+		}
+		// блокируем с удвоением времени при каждой следующей блокировке
+		var lockout = l.Lockout
+		for i := 0; i < failures.locks && lockout < l.MaxLockout; i++ {
+			lockout *= 2
+		}
+		if lockout > l.MaxLockout {
+			lockout = l.MaxLockout
+		}
+		failures.count = 0
+		failures.locks++
+		failures.until = now.Add(lockout)
+		if lockout > locked {
+			locked = lockout
+		}
+	}
+	return locked
+}
+
+// evict удаляет счетчик с самой давней неудачной попыткой, освобождая место
+// для нового. Должна вызываться с блокировкой.
+func (l *LoginLimiter) evict() {
+	var oldest string
+	var last time.Time
+	for key, failures := range l.failures {
+		if oldest == "" || failures.last.Before(last) {
+			oldest, last = key, failures.last
+		}
+	}
+	delete(l.failures, oldest)
+}
+
+// Configure изменяет параметры ограничения. Уже установленные блокировки
+// продолжают действовать.
+func (l *LoginLimiter) Configure(attempts int, lockout, maxLockout time.Duration) {
+	l.mu.Lock()
+	l.Attempts = attempts
+	l.Lockout = lockout
+	l.MaxLockout = maxLockout
+	l.mu.Unlock()
+}
+
+// Succeeded сбрасывает счетчики неудачных попыток авторизации для указанных
+// ключей. Обычно сбрасывается только счетчик логина, а счетчик IP-адреса
+// истекает сам.
+func (l *LoginLimiter) Succeeded(keys ...string) {
+	l.mu.Lock()
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+	l.mu.Unlock()
+}
+
+// RateLimiter ограничивает частоту запросов по алгоритму "token bucket":
+// для каждого ключа допускается не более Limit запросов подряд, а
+// возможность выполнения запросов восстанавливается равномерно в течение
+// периода Period. Если установлен флаг Window, то используется скользящее
+// окно: для каждого ключа допускается не более Limit запросов за любой
+// период Period, что позволяет использовать ограничение как квоту.
+type RateLimiter struct {
+	Limit   int           // количество запросов за период; 0 — без ограничений
+	Period  time.Duration // период восстановления
+	Window  bool          // ограничение скользящим окном
+	buckets map[string]*rateBucket
+	mu      sync.Mutex
+}
+
+// rateBucket описывает состояние ограничения для одного ключа.
+type rateBucket struct {
+	tokens   float64     // количество доступных запросов
+	updated  time.Time   // время последнего пересчета
+	times    []time.Time // время разрешенных запросов в скользящем окне
+	requests int         // количество разрешенных запросов
+	rejected int         // количество отклоненных запросов
+}
+
+// RateStat описывает счетчики запросов для одного ключа.
+type RateStat struct {
+	Key       string // ключ ограничения
+	Remaining int    // количество доступных запросов
+	Requests  int    // количество разрешенных запросов
+	Rejected  int    // количество отклоненных запросов
+}
+
+// refill пересчитывает количество доступных запросов. Должна вызываться с
+// блокировкой.
+func (l *RateLimiter) refill(bucket *rateBucket, now time.Time) {
+	if l.Limit <= 0 || l.Period <= 0 {
+		return
+	}
+	if l.Window {
+		// удаляем запросы, вышедшие за пределы окна
+		var i int
+		for i < len(bucket.times) && now.Sub(bucket.times[i]) >= l.Period {
+			i++
+		}
+		bucket.times = bucket.times[i:]
+		bucket.tokens = float64(l.Limit - len(bucket.times))
+		if bucket.tokens < 0 {
+			bucket.tokens = 0
+		}
+		return
+	}
+	var rate = float64(l.Limit) / l.Period.Seconds()
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * rate
+	if bucket.tokens > float64(l.Limit) {
+		bucket.tokens = float64(l.Limit)
+	}
+	bucket.updated = now
+}
+
+// Allow проверяет, разрешен ли запрос для указанного ключа, и уменьшает
+// количество доступных запросов. Возвращает так же количество оставшихся
+// запросов и время до полного восстановления ограничения или, если запрос
+// не разрешен, до возможности выполнить следующий запрос.
+func (l *RateLimiter) Allow(key string) (allowed bool, remaining int, reset time.Duration) {
+	var now = time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Limit <= 0 || l.Period <= 0 {
+		return true, -1, 0 // ограничение отключено
+	}
+	if l.buckets == nil {
+		l.buckets = make(map[string]*rateBucket)
+	}
+	var bucket, ok = l.buckets[key]
+	if !ok {
+		// удаляем давно не используемые ключи
+		if len(l.buckets) > 1000 {
+			for key, bucket := range l.buckets {
+				if now.Sub(bucket.updated) > l.Period {
+					delete(l.buckets, key)
+				}
+			}
+		}
+		bucket = &rateBucket{tokens: float64(l.Limit), updated: now}
+		l.buckets[key] = bucket
+	} else {
+		l.refill(bucket, now)
+	}
+	if l.Window {
+		return l.allowWindow(bucket, now)
+	}
+	var rate = float64(l.Limit) / l.Period.Seconds()
+	if bucket.tokens < 1 {
+		bucket.rejected++
+		var wait = time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+		return false, 0, wait
+	}
+	bucket.tokens--
+	bucket.requests++
+	var full = time.Duration((float64(l.Limit) - bucket.tokens) / rate *
+		float64(time.Second))
+	return true, int(bucket.tokens), full
+}
+
+// allowWindow проверяет ограничение скользящим окном. Должна вызываться с
+// блокировкой после пересчета доступных запросов.
+func (l *RateLimiter) allowWindow(bucket *rateBucket, now time.Time) (bool, int, time.Duration) {
+	if len(bucket.times) >= l.Limit {
+		bucket.rejected++
+		// следующий запрос возможен после выхода из окна самого раннего
+		var wait = bucket.times[len(bucket.times)-l.Limit].Add(l.Period).Sub(now)
+		return false, 0, wait
+	}
+	bucket.times = append(bucket.times, now)
+	bucket.tokens = float64(l.Limit - len(bucket.times))
+	bucket.updated = now
+	bucket.requests++
+	return true, l.Limit - len(bucket.times), l.Period
+}
+
+// Stats возвращает счетчики запросов, упорядоченные по ключу.
+func (l *RateLimiter) Stats() []*RateStat {
+	var now = time.Now()
+	l.mu.Lock()
+	var stats = make([]*RateStat, 0, len(l.buckets))
+	for key, bucket := range l.buckets {
+		l.refill(bucket, now)
+		stats = append(stats, &RateStat{
+			Key:       key,
+			Remaining: int(bucket.tokens),
+			Requests:  bucket.requests,
+			Rejected:  bucket.rejected,
+		})
+	}
+	l.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Key < stats[j].Key
+	})
+	return stats
+}
+
+// Configure изменяет параметры ограничения. Счетчики сохраняются.
+func (l *RateLimiter) Configure(limit int, period time.Duration) {
+	l.mu.Lock()
+	l.Limit = limit
+	l.Period = period
+	l.mu.Unlock()
+}
+
+// rateLimit проверяет ограничение частоты запросов для указанного ключа и
+// добавляет в ответ заголовки RateLimit-* с информацией о нем. Если запрос
+// не разрешен, то возвращается ошибка с заголовком Retry-After.
+func rateLimit(c *rest.Context, l *RateLimiter, key string) error {
+	if l == nil {
+		return nil
+	}
+	allowed, remaining, reset := l.Allow(key)
+	if remaining < 0 {
+		return nil // ограничение отключено
+	}
+	l.mu.Lock()
+	var limit = l.Limit
+	l.mu.Unlock()
+	var seconds = strconv.Itoa(int(math.Ceil(reset.Seconds())))
+	c.SetHeader("RateLimit-Limit", strconv.Itoa(limit))
+	c.SetHeader("RateLimit-Remaining", strconv.Itoa(remaining))
+	c.SetHeader("RateLimit-Reset", seconds)
+	if !allowed {
+		c.SetHeader("Retry-After", seconds)
+		c.AddLogField("rateLimit", key)
+		return c.Error(http.StatusTooManyRequests, "rate limit exceeded")
+	}
+	return nil
+}
+
+// configureLimits устанавливает параметры ограничений авторизации, частоты
+// запросов и количества звонков в соответствии с конфигурацией. Счетчики
+// ограничений при этом сохраняются.
+func (h *HTTPHandler) configureLimits(config *Config) {
+	var limiter = config.loginLimiter()
+	apiLoginLimiter.Configure(limiter.Attempts, limiter.Lockout,
+		limiter.MaxLockout)
+	h.loginLimiter = apiLoginLimiter
+	apiRateLimiter.Configure(config.Server.RateLimit, time.Minute)
+	h.rateLimiter = apiRateLimiter
+	apiCallQuota.Configure(config.Server.CallQuota, time.Hour)
+	h.callQuota = apiCallQuota
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// shiftRateLimiter сдвигает в прошлое время запросов всех ключей, имитируя
+// прошедшее время.
+func shiftRateLimiter(l *RateLimiter, d time.Duration) {
+	l.mu.Lock()
+	for _, bucket := range l.buckets {
+		bucket.updated = bucket.updated.Add(-d)
+		for i := range bucket.times {
+			bucket.times[i] = bucket.times[i].Add(-d)
+		}
+	}
+	l.mu.Unlock()
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	var tests = []struct {
+		name     string
+		limiter  *RateLimiter
+		requests int
+		allowed  int
+	}{
+		{"bucket", &RateLimiter{Limit: 3, Period: time.Hour}, 5, 3},
+		{"window", &RateLimiter{Limit: 3, Period: time.Hour, Window: true}, 5, 3},
+		{"single", &RateLimiter{Limit: 1, Period: time.Minute}, 2, 1},
+		{"disabled", &RateLimiter{Period: time.Hour}, 5, 5},
+		{"no period", &RateLimiter{Limit: 1}, 5, 5},
+	}
+	for _, test := range tests {
+		var allowed int
+		for i := 0; i < test.requests; i++ {
+			if ok, _, _ := test.limiter.Allow("key"); ok {
+				allowed++
+			}
+		}
+		if allowed != test.allowed {
+			t.Errorf("%s: %d requests allowed, want %d", test.name, allowed,
+				test.allowed)
+		}
+	}
+}
+
+func TestRateLimiterRemaining(t *testing.T) {
+	var tests = []struct {
+		name      string
+		limiter   *RateLimiter
+		remaining []int // оставшиеся запросы после каждого запроса
+	}{
+		{"bucket", &RateLimiter{Limit: 3, Period: time.Hour}, []int{2, 1, 0, 0}},
+		{"window", &RateLimiter{Limit: 3, Period: time.Hour, Window: true},
+			[]int{2, 1, 0, 0}},
+		{"disabled", &RateLimiter{}, []int{-1, -1}},
+	}
+	for _, test := range tests {
+		for i, want := range test.remaining {
+			if _, remaining, _ := test.limiter.Allow("key"); remaining != want {
+				t.Errorf("%s: request %d: remaining %d, want %d", test.name,
+					i+1, remaining, want)
+			}
+		}
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	// после исчерпания ограничения доступные запросы восстанавливаются
+	// равномерно в течение периода
+	var tests = []struct {
+		name    string
+		elapsed time.Duration
+		allowed int
+	}{
+		{"immediately", 0, 0},
+		{"quarter", 15 * time.Minute, 1},
+		{"half", 30 * time.Minute, 2},
+		{"hour", time.Hour, 4},
+		{"two hours", 2 * time.Hour, 4},
+	}
+	for _, test := range tests {
+		var limiter = &RateLimiter{Limit: 4, Period: time.Hour}
+		for i := 0; i < 4; i++ {
+			limiter.Allow("key")
+		}
+		shiftRateLimiter(limiter, test.elapsed)
+		var allowed int
+		for i := 0; i < 5; i++ {
+			if ok, _, _ := limiter.Allow("key"); ok {
+				allowed++
+			}
+		}
+		if allowed != test.allowed {
+			t.Errorf("%s: %d requests allowed, want %d", test.name, allowed,
+				test.allowed)
+		}
+	}
+}
+
+func TestRateLimiterWindow(t *testing.T) {
+	// скользящее окно освобождается только по истечении периода, поэтому за
+	// любой час проходит не больше Limit звонков
+	var tests = []struct {
+		name    string
+		elapsed time.Duration
+		allowed bool
+	}{
+		{"immediately", 0, false},
+		{"quarter", 15 * time.Minute, false},
+		{"almost hour", 59 * time.Minute, false},
+		{"hour", time.Hour, true},
+	}
+	for _, test := range tests {
+		var limiter = &RateLimiter{Limit: 4, Period: time.Hour, Window: true}
+		for i := 0; i < 4; i++ {
+			limiter.Allow("key")
+		}
+		shiftRateLimiter(limiter, test.elapsed)
+		if allowed, _, _ := limiter.Allow("key"); allowed != test.allowed {
+			t.Errorf("%s: allowed %v, want %v", test.name, allowed,
+				test.allowed)
+		}
+	}
+}
+
+func TestRateLimiterWindowReset(t *testing.T) {
+	var limiter = &RateLimiter{Limit: 2, Period: time.Hour, Window: true}
+	limiter.Allow("key")
+	shiftRateLimiter(limiter, 30*time.Minute)
+	limiter.Allow("key")
+	// следующий запрос возможен, когда из окна выйдет первый запрос
+	allowed, _, reset := limiter.Allow("key")
+	if allowed {
+		t.Fatal("request allowed over the quota")
+	}
+	if reset <= 29*time.Minute || reset > 30*time.Minute {
+		t.Errorf("reset %v, want about 30m", reset)
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	var limiter = &RateLimiter{Limit: 1, Period: time.Hour}
+	for _, key := range []string{"3095", "key:a 3095", "key:a 3096"} {
+		if allowed, _, _ := limiter.Allow(key); !allowed {
+			t.Errorf("first request for %q not allowed", key)
+		}
+		if allowed, _, _ := limiter.Allow(key); allowed {
+			t.Errorf("second request for %q allowed", key)
+		}
+	}
+	var stats = limiter.Stats()
+	if len(stats) != 3 {
+		t.Fatalf("got %d stats, want 3", len(stats))
+	}
+	for _, stat := range stats {
+		if stat.Requests != 1 || stat.Rejected != 1 || stat.Remaining != 0 {
+			t.Errorf("%s: bad stat %+v", stat.Key, stat)
+		}
+	}
+}
+
+func TestRateLimiterConfigure(t *testing.T) {
+	var limiter = &RateLimiter{Limit: 2, Period: time.Hour, Window: true}
+	limiter.Allow("key")
+	limiter.Allow("key")
+	limiter.Configure(3, time.Hour)
+	// счетчики сохраняются: доступен только один дополнительный запрос
+	var tests = []bool{true, false}
+	for i, want := range tests {
+		if allowed, _, _ := limiter.Allow("key"); allowed != want {
+			t.Errorf("request %d: allowed %v, want %v", i+1, allowed, want)
+		}
+	}
+}
+
+// unlockLoginLimiter снимает действующие блокировки, не сбрасывая счетчики
+// блокировок.
+func unlockLoginLimiter(l *LoginLimiter) {
+	l.mu.Lock()
+	for _, failures := range l.failures {
+		failures.until = time.Now().Add(-time.Second)
+	}
+	l.mu.Unlock()
+}
+
+func TestLoginLimiterLockout(t *testing.T) {
+	var limiter = &LoginLimiter{
+		Attempts:   3,
+		Lockout:    time.Minute,
+		MaxLockout: 4 * time.Minute,
+	}
+	// время блокировки удваивается, пока не достигнет максимального
+	var tests = []time.Duration{time.Minute, 2 * time.Minute,
+		4 * time.Minute, 4 * time.Minute}
+	for i, want := range tests {
+		for n := 1; n < limiter.Attempts; n++ {
+			if locked := limiter.Failed("login:admin"); locked != 0 {
+				t.Fatalf("lock %d: locked after %d attempts", i+1, n)
+			}
+		}
+		if locked := limiter.Failed("login:admin"); locked != want {
+			t.Errorf("lock %d: lockout %v, want %v", i+1, locked, want)
+		}
+		if locked := limiter.Locked("login:admin"); locked <= 0 || locked > want {
+			t.Errorf("lock %d: Locked() = %v, want up to %v", i+1, locked, want)
+		}
+		unlockLoginLimiter(limiter)
+		if locked := limiter.Locked("login:admin"); locked != 0 {
+			t.Errorf("lock %d: still locked for %v", i+1, locked)
+		}
+	}
+}
+
+func TestLoginLimiterKeys(t *testing.T) {
+	var tests = []struct {
+		name      string
+		succeeded []string
+		login     bool // логин заблокирован после успешной авторизации
+		ip        bool // IP-адрес заблокирован после успешной авторизации
+	}{
+		{"nothing reset", nil, true, true},
+		{"login reset", []string{"login:admin"}, false, true},
+		{"both reset", []string{"login:admin", "ip:10.0.0.1"}, false, false},
+	}
+	for _, test := range tests {
+		var limiter = &LoginLimiter{
+			Attempts:   2,
+			Lockout:    time.Minute,
+			MaxLockout: time.Hour,
+		}
+		limiter.Failed("login:admin", "ip:10.0.0.1")
+		limiter.Failed("login:admin", "ip:10.0.0.1")
+		limiter.Succeeded(test.succeeded...)
+		if locked := limiter.Locked("login:admin") > 0; locked != test.login {
+			t.Errorf("%s: login locked %v, want %v", test.name, locked,
+				test.login)
+		}
+		if locked := limiter.Locked("ip:10.0.0.1") > 0; locked != test.ip {
+			t.Errorf("%s: ip locked %v, want %v", test.name, locked, test.ip)
+		}
+		if locked := limiter.Locked("login:other", "ip:10.0.0.1") > 0; locked != test.ip {
+			t.Errorf("%s: other login from ip locked %v, want %v", test.name,
+				locked, test.ip)
+		}
+	}
+}
+
+func TestLoginLimiterExpired(t *testing.T) {
+	var tests = []struct {
+		name   string
+		idle   time.Duration // время после последней неудачной попытки
+		locked bool          // блокировка после следующей неудачной попытки
+	}{
+		{"recent", time.Minute, true},
+		{"expired", 2 * time.Hour, false},
+	}
+	for _, test := range tests {
+		var limiter = &LoginLimiter{
+			Attempts:   2,
+			Lockout:    time.Minute,
+			MaxLockout: time.Hour,
+		}
+		limiter.Failed("login:admin")
+		limiter.mu.Lock()
+		limiter.failures["login:admin"].last = time.Now().Add(-test.idle)
+		limiter.mu.Unlock()
+		if locked := limiter.Failed("login:admin") > 0; locked != test.locked {
+			t.Errorf("%s: locked %v, want %v", test.name, locked, test.locked)
+		}
+	}
+}
+
+func TestLoginLimiterEvict(t *testing.T) {
+	defer func(limit int) { loginFailuresLimit = limit }(loginFailuresLimit)
+	loginFailuresLimit = 2
+	var limiter = &LoginLimiter{
+		Attempts:   5,
+		Lockout:    time.Minute,
+		MaxLockout: time.Hour,
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		limiter.Failed(key)
+		time.Sleep(time.Millisecond) // время попыток должно различаться
+	}
+	if len(limiter.failures) != loginFailuresLimit {
+		t.Fatalf("%d counters stored, want %d", len(limiter.failures),
+			loginFailuresLimit)
+	}
+	if _, ok := limiter.failures["a"]; ok {
+		t.Error("oldest counter was not evicted")
+	}
+}
+
+func TestLoginLimiterDisabled(t *testing.T) {
+	var limiter = new(LoginLimiter)
+	for i := 0; i < 10; i++ {
+		if locked := limiter.Failed("login:admin"); locked != 0 {
+			t.Fatalf("locked for %v with disabled limiter", locked)
+		}
+	}
+	if locked := limiter.Locked("login:admin"); locked != 0 {
+		t.Errorf("Locked() = %v with disabled limiter", locked)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// configWatchInterval задает периодичность проверки изменения
+// конфигурационного файла.
+var configWatchInterval = time.Second * 5
+
+// configState описывает параметры конфигурации, изменение которых требует
+// перезапуска частей сервиса.
+type configState struct {
+	serverHost   string
+	mxHost       string
+	mxLogin      string
+	mxPassword   string
+	userSessions bool
+	logLevel     int8
+}
+
+// state возвращает текущие параметры конфигурации, изменение которых
+// требует перезапуска. Должна вызываться с блокировкой конфигурации.
+func (c *Config) state() configState {
+	return configState{
+		serverHost:   c.Server.Host,
+		mxHost:       c.MX.Host,
+		mxLogin:      c.MX.Login,
+		mxPassword:   string(c.MX.Password),
+		userSessions: c.MX.UserSessions,
+		logLevel:     c.Server.LogLevel,
+	}
+}
+
+// diff возвращает список изменившихся полей конфигурации со старыми и новыми
+// значениями. Должна вызываться с блокировкой конфигурации.
+func (c *Config) diff(n *Config) [][3]string {
+	var changes [][3]string
+	var names = append([]string(nil), configFields...)
+	var params = make(map[string]bool)
+	for key := range c.Params {
+		params[key] = true
+	}
+	for key := range n.Params {
+		params[key] = true
+	}
+	var keys = make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, "params."+key)
+	}
+	sort.Strings(keys)
+	for _, name := range append(names, keys...) {
+		var oldValue, newValue = c.field(name), n.field(name)
+		var changed = oldValue != newValue
+		// у параметров учитывается и тип значения
+		if key := strings.TrimPrefix(name, "params."); key != name {
+			changed = !bytes.Equal(c.Params[key], n.Params[key])
+		}
+		if !changed {
+			continue
+		}
+		if name == "mx.password" {
+			oldValue, newValue = secretMask, secretMask
+		}
+		changes = append(changes, [3]string{name, oldValue, newValue})
+	}
+	// параметры групп MX и внутренних номеров: "group:Sales/params.key"
+	var scopes = make(map[string]bool)
+	for _, scope := range append(c.paramScopes()[1:], n.paramScopes()[1:]...) {
+		scopes[scope] = true
+	}
+	var scopeList = make([]string, 0, len(scopes))
+	for scope := range scopes {
+		scopeList = append(scopeList, scope)
+	}
+	sort.Strings(scopeList)
+	for _, scope := range scopeList {
+		var oldParams, _ = c.paramsScope(scope, false)
+		var newParams, _ = n.paramsScope(scope, false)
+		var keys = make(map[string]bool)
+		for key := range oldParams {
+			keys[key] = true
+		}
+		for key := range newParams {
+			keys[key] = true
+		}
+		var keyList = make([]string, 0, len(keys))
+		for key := range keys {
+			keyList = append(keyList, key)
+		}
+		sort.Strings(keyList)
+		for _, key := range keyList {
+			var oldValue, newValue = oldParams[key], newParams[key]
+			if bytes.Equal(oldValue, newValue) {
+				continue
+			}
+			changes = append(changes, [3]string{scope + "/params." + key,
+				paramText(oldValue), paramText(newValue)})
+		}
+	}
+	// учетные записи администраторов и ключи доступа к API
+	var admins = func(c *Config) string {
+		var list = make([]string, 0, len(c.Admins))
+		for _, account := range c.Admins {
+			list = append(list, account.Login)
+		}
+		sort.Strings(list)
+		return strings.Join(list, ",")
+	}
+	if oldValue, newValue := admins(c), admins(n); oldValue != newValue {
+		changes = append(changes, [3]string{"admins", oldValue, newValue})
+	}
+	for _, account := range n.Admins {
+		if old := c.admin(account.Login); old != nil &&
+			!bytes.Equal(old.Password, account.Password) {
+			changes = append(changes, [3]string{
+				"admins." + account.Login + ".password", secretMask, secretMask})
+		}
+	}
+	var apiKeys = func(c *Config) string {
+		var list = make([]string, 0, len(c.APIKeys))
+		for _, apiKey := range c.APIKeys {
+			list = append(list, apiKey.Name+" ("+apiKey.ID+")")
+		}
+		sort.Strings(list)
+		return strings.Join(list, ",")
+	}
+	if oldValue, newValue := apiKeys(c), apiKeys(n); oldValue != newValue {
+		changes = append(changes, [3]string{"apikeys", oldValue, newValue})
+	}
+	return changes
+}
+
+// update заменяет значения конфигурации значениями из новой загруженной
+// конфигурации. Должна вызываться с блокировкой конфигурации.
+func (c *Config) update(n *Config) {
+	// сохраняем интервалы использованных одноразовых кодов администраторов
+	for _, account := range n.Admins {
+		if old := c.admin(account.Login); old != nil {
+			account.totpUsed = old.totpUsed
+		}
+	}
+	c.Admins = n.Admins
+	c.Server = n.Server
+	c.MX = n.MX
+	c.Roles = n.Roles
+	c.APIKeys = n.APIKeys
+	c.Params = n.Params
+	c.GroupParams = n.GroupParams
+	c.ExtParams = n.ExtParams
+	c.fileValues = n.fileValues
+	c.modified = n.modified
+}
+
+// apply применяет изменения конфигурации к запущенному сервису, перезапуская
+// только изменившиеся части: соединение с сервером MX, HTTP сервер и уровень
+// вывода лога. Ограничения запросов, роли и параметры используются
+// обработчиками напрямую из конфигурации и перезапуска не требуют.
+func (a *Admin) apply(old configState) {
+	a.config.mu.RLock()
+	var state = a.config.state()
+	a.config.mu.RUnlock()
+	if state.logLevel != old.logLevel {
+		setLogLevel(state.logLevel)
+	}
+	var mxChanged = state.mxHost != old.mxHost ||
+		state.mxLogin != old.mxLogin || state.mxPassword != old.mxPassword
+	var serverChanged = state.serverHost != old.serverHost
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// если сервис не запущен, то запускаем его полностью
+	if a.proxy == nil {
+		if (!mxChanged && !serverChanged) || a.config.setupRequired() {
+			return
+		}
+		proxy, err := NewProxy(a.config)
+		a.config.mu.Lock()
+		a.proxy, a.config.err = proxy, err
+		a.config.mu.Unlock()
+		return
+	}
+	var handler = a.proxy.handler
+	a.config.mu.RLock()
+	handler.configureLimits(a.config)
+	a.config.mu.RUnlock()
+	if mxChanged {
+		// при ошибке подключения сохраняется текущее соединение
+		var err = handler.reconnect(state.mxHost, state.mxLogin, state.mxPassword)
+		if err != nil {
+			a.log.Error("mx reconnect error", err)
+		}
+		a.config.mu.Lock()
+		a.config.err = err
+		a.config.mu.Unlock()
+	}
+	if state.userSessions != old.userSessions {
+		handler.setUserSessions(state.userSessions)
+	}
+	if serverChanged {
+		// при ошибке продолжает работать текущий сервер
+		if err := a.proxy.Restart(a.config); err != nil {
+			a.log.Error("server restart error", err)
+			a.config.mu.Lock()
+			a.config.err = err
+			a.config.mu.Unlock()
+		}
+	}
+}
+
+// Reload загружает конфигурацию из файла и применяет изменения к
+// запущенному сервису. Переопределенные значения полей сохраняются.
+// Изменения записываются в журнал от имени actor: администратора или
+// источника перезагрузки (file, SIGHUP).
+func (a *Admin) Reload(actor string) error {
+	a.config.mu.RLock()
+	var filename, overrides = a.config.filename, a.config.overrides
+	a.config.mu.RUnlock()
+	config, err := LoadConfig(filename, overrides)
+	if err == nil && len(config.Admins) == 0 {
+		err = errors.New("no admin accounts")
+	}
+	if err != nil {
+		a.log.Error("config reload error", err)
+		return err
+	}
+	a.config.mu.Lock()
+	var old = a.config.state()
+	var changes = a.config.diff(config)
+	var removed []string // удаленные администраторы
+	for _, account := range a.config.Admins {
+		if config.admin(account.Login) == nil {
+			removed = append(removed, account.Login)
+		}
+	}
+	a.config.update(config)
+	a.config.mu.Unlock()
+	if len(changes) == 0 {
+		return nil
+	}
+	for _, login := range removed {
+		a.sessions.StopLogin(login)
+	}
+	for _, change := range changes {
+		a.auditAs(actor, change[0], change[1], change[2])
+	}
+	a.apply(old)
+	a.log.Info("config reloaded", "file", filename, "changes", len(changes))
+	return nil
+}
+
+// WatchConfig периодически проверяет время изменения конфигурационного
+// файла и перезагружает конфигурацию, если файл был изменен не сервисом.
+func (a *Admin) WatchConfig() {
+	var failed time.Time // время изменения файла с ошибкой
+	for range time.Tick(configWatchInterval) {
+		// время изменения проверяется с той же блокировкой, с которой
+		// сохраняется файл, поэтому сохранение самим сервисом не вызывает
+		// перезагрузку
+		a.config.mu.RLock()
+		var filename = a.config.filename
+		fi, err := os.Stat(filename)
+		var changed = err == nil && !fi.ModTime().Equal(a.config.modified)
+		a.config.mu.RUnlock()
+		if !changed || fi.ModTime().Equal(failed) {
+			continue
+		}
+		a.log.Info("config file changed", "file", filename)
+		if err := a.Reload("file"); err != nil {
+			failed = fi.ModTime()
+		}
+	}
+}
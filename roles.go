@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+// роли пользователей API
+const (
+	roleAgent       = "agent"       // оператор: полный доступ к своим данным
+	roleSupervisor  = "supervisor"  // супервизор: мониторинг других операторов
+	roleReadOnly    = "read-only"   // только чтение своих данных
+	roleIntegration = "integration" // интеграция: только адресная книга
+)
+
+// roles содержит список поддерживаемых ролей в порядке убывания приоритета.
+// Если пользователь входит в несколько групп с разными ролями, то выбирается
+// роль с наибольшим приоритетом.
+var roles = []string{roleSupervisor, roleAgent, roleReadOnly, roleIntegration}
+
+// области доступа к функциям API
+const (
+	scopeContacts  = "contacts"  // адресная книга
+	scopeRead      = "read"      // события, журнал звонков, голосовая почта
+	scopeCall      = "call"      // звонки, перевод и сброс звонков
+	scopeSettings  = "settings"  // переадресация, управление голосовой почтой
+	scopeSupervise = "supervise" // события других пользователей
+	scopeAdmin     = "admin"     // JSON API административного сервера
+)
+
+// scopes содержит список поддерживаемых областей доступа. Область admin
+// выдается только ключам API и не входит ни в одну роль.
+var scopes = []string{scopeContacts, scopeRead, scopeCall, scopeSettings,
+	scopeSupervise, scopeAdmin}
+
+// roleScopes задает области доступа, разрешенные для каждой роли.
+var roleScopes = map[string][]string{
+	roleAgent:       {scopeContacts, scopeRead, scopeCall, scopeSettings},
+	roleSupervisor:  {scopeContacts, scopeRead, scopeCall, scopeSettings, scopeSupervise},
+	roleReadOnly:    {scopeContacts, scopeRead},
+	roleIntegration: {scopeContacts},
+}
+
+// validScope возвращает true, если область доступа с таким названием
+// поддерживается.
+func validScope(scope string) bool {
+	for _, name := range scopes {
+		if name == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// validRole возвращает true, если роль с таким названием поддерживается.
+func validRole(role string) bool {
+	for _, name := range roles {
+		if name == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Roles описывает назначение ролей пользователям и группам MX.
+type Roles struct {
+	Users  map[string]string // роли по внутреннему номеру пользователя
+	Groups map[string]string // роли по названию группы MX
+}
+
+// rolesText возвращает текстовое представление назначенных ролей: каждая
+// строка содержит имя и роль, разделенные знаком равенства.
+func rolesText(list map[string]string) string {
+	var lines = make([]string, 0, len(list))
+	for name, role := range list {
+		lines = append(lines, name+"="+role)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// parseRoles разбирает текстовое представление назначенных ролей. Строки с
+// неизвестными ролями пропускаются.
+func parseRoles(text string) map[string]string {
+	var list = make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		var indx = strings.IndexByte(line, '=')
+		if indx < 0 {
+			continue
+		}
+		var name = strings.TrimSpace(line[:indx])
+		var role = strings.TrimSpace(line[indx+1:])
+		if name == "" || !validRole(role) {
+			log.Warn("bad role assignment", "line", line)
+			continue
+		}
+		list[name] = role
+	}
+	return list
+}
+
+// userGroups возвращает отсортированный список названий групп MX, в которые
+// входит пользователь с указанным внутренним номером. Список групп
+// кешируется, чтобы не запрашивать его у сервера MX при каждом запросе.
+func (h *HTTPHandler) userGroups(ext string) ([]string, error) {
+	groups, err := h.mx().cachedGroups()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, group := range groups {
+		for _, member := range group.Members {
+			if member == ext {
+				names = append(names, group.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// userRole возвращает роль пользователя с указанным внутренним номером. Роль,
+// назначенная пользователю, имеет приоритет перед ролями его групп. Если роль
+// не назначена, то возвращается роль оператора.
+func (h *HTTPHandler) userRole(ext string) string {
+	if h.config == nil {
+		return roleAgent
+	}
+	h.config.mu.RLock()
+	var role = h.config.Roles.Users[ext]
+	var groupRoles = len(h.config.Roles.Groups) > 0
+	h.config.mu.RUnlock()
+	if role != "" {
+		return role
+	}
+	if !groupRoles {
+		return roleAgent
+	}
+	groups, err := h.userGroups(ext)
+	if err != nil {
+		log.Error("mx groups error", err)
+		return roleAgent
+	}
+	h.config.mu.RLock()
+	defer h.config.mu.RUnlock()
+	var found = make(map[string]bool)
+	for _, group := range groups {
+		if role, ok := h.config.Roles.Groups[group]; ok {
+			found[role] = true
+		}
+	}
+	for _, role := range roles {
+		if found[role] {
+			return role
+		}
+	}
+	return roleAgent
+}
+
+// Allowed возвращает true, если токен разрешает доступ к указанной области.
+// Для токенов пользователей области доступа определяются их ролью; токены без
+// указания роли считаются токенами оператора.
+func (t *TokenInfo) Allowed(scope string) bool {
+	var list = t.Scopes
+	if t.Key == nil {
+		var role = t.Role
+		if role == "" {
+			role = roleAgent
+		}
+		list = roleScopes[role]
+	}
+	for _, name := range list {
+		if name == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Access возвращает обработчик, который разрешает выполнение запроса только
+// при наличии у токена доступа к указанной области и ограничивает частоту
+// запросов к маршруту route для каждого токена.
+func (h *HTTPHandler) Access(route, scope string, handler rest.Handler) rest.Handler {
+	return func(c *rest.Context) error {
+		token, err := h.verifyToken(c) // распаковываем и проверяем токен
+		if err != nil {
+			return err
+		}
+		// обработчик получает проверенный токен без повторной проверки
+		withTokenInfo(c, token)
+		if !token.Allowed(scope) {
+			c.AddLogField("scope", scope)
+			return c.Error(http.StatusForbidden, "access denied")
+		}
+		if err := rateLimit(c, h.rateLimiter, token.Subject()+" "+route); err != nil {
+			return err
+		}
+		return handler(c)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// параметры шифрования секретов в конфигурационном файле
+var (
+	secretKeyEnv  = strings.ToUpper(appName) + "_SECRET_KEY" // переменная окружения с ключом
+	secretKeyName = lowerAppName + ".key"                    // файл с ключом
+	secretKey     []byte                                     // ключ шифрования секретов
+)
+
+// secretPrefix добавляется к зашифрованным значениям в конфигурационном
+// файле, чтобы отличать их от незашифрованных.
+const secretPrefix = "enc:v1:"
+
+// Secret описывает секретное значение конфигурации. Если задан ключ
+// шифрования, то при сохранении конфигурации значение шифруется
+// (AES-256-GCM), а при загрузке — расшифровывается. Без ключа значение
+// сохраняется в виде base64, как обычный []byte.
+type Secret []byte
+
+// MarshalJSON возвращает зашифрованное представление секрета.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if secretKey == nil || len(s) == 0 {
+		return json.Marshal([]byte(s))
+	}
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	var nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	var data = gcm.Seal(nonce, nonce, s, nil)
+	return json.Marshal(secretPrefix + base64.StdEncoding.EncodeToString(data))
+}
+
+// UnmarshalJSON расшифровывает секрет. Незашифрованные значения
+// поддерживаются для совместимости со старым форматом конфигурации.
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	var value []byte
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil ||
+		!strings.HasPrefix(str, secretPrefix) {
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		*s = value
+		return nil
+	}
+	if secretKey == nil {
+		return errors.New("config secret is encrypted, but key is not set (" +
+			secretKeyEnv + " or " + secretKeyName + ")")
+	}
+	value, err := base64.StdEncoding.DecodeString(
+		strings.TrimPrefix(str, secretPrefix))
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	if len(value) < gcm.NonceSize() {
+		return errors.New("bad encrypted config secret")
+	}
+	var nonce = value[:gcm.NonceSize()]
+	value, err = gcm.Open(nil, nonce, value[gcm.NonceSize():], nil)
+	if err != nil {
+		return errors.New("config secret decrypt error: bad key")
+	}
+	*s = value
+	return nil
+}
+
+// decodeSecretKey проверяет и возвращает ключ шифрования, представленный в
+// виде base64.
+func decodeSecretKey(text string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("secret key must be 32 bytes long")
+	}
+	return key, nil
+}
+
+// LoadSecretKey загружает ключ шифрования секретов из переменной окружения
+// или, если она не задана, из файла. Если ключ не задан ни там, ни там, то
+// возвращается nil и секреты не шифруются.
+func LoadSecretKey() ([]byte, error) {
+	if text := os.Getenv(secretKeyEnv); text != "" {
+		return decodeSecretKey(text)
+	}
+	data, err := ioutil.ReadFile(secretKeyName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeSecretKey(string(data))
+}
+
+// NewSecretKey создает новый ключ шифрования секретов и сохраняет его в файл,
+// доступный только для владельца.
+func NewSecretKey() ([]byte, error) {
+	var key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(secretKeyName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.WriteString(base64.StdEncoding.EncodeToString(key) + "\n")
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return key, err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/mx"
+	"github.com/mdigger/rest"
+)
+
+// sessionKeepAlive задает интервал отправки команды для поддержки
+// пользовательского соединения с сервером MX.
+var sessionKeepAlive = time.Second * 30
+
+// UserSession описывает пользовательское соединение с сервером MX. Команды
+// пользователя в этом режиме отправляются через его собственное соединение,
+// поэтому сервер MX применяет к ним права этого пользователя и записывает их
+// в журнал от его имени.
+type UserSession struct {
+	*MXServer           // соединение пользователя
+	Ext       string    // внутренний номер пользователя
+	expires   time.Time // время окончания действия сессии
+}
+
+// sessionStart авторизует пользователя на сервере MX и сохраняет его
+// соединение до окончания срока действия токена. Если сессия для этого
+// пользователя уже открыта, то продлевается срок ее действия, а новое
+// соединение закрывается.
+func (h *HTTPHandler) sessionStart(login, password string) (*mx.Info, error) {
+	conn, info, err := h.mx().UserConnect(login, password)
+	if err != nil {
+		return nil, err
+	}
+	var expires = time.Now().Add(jwtConfig.Expires)
+	if data, ok := h.sessions.Load(info.Ext); ok {
+		var session = data.(*UserSession)
+		h.mu.Lock()
+		if expires.After(session.expires) {
+			session.expires = expires
+		}
+		h.mu.Unlock()
+		conn.Logout()
+		conn.Close()
+		log.Info("mx session extended", "ext", info.Ext)
+		return info, nil
+	}
+	var session = &UserSession{
+		MXServer: &MXServer{mxHost: h.mx().mxHost, conn: conn},
+		Ext:      info.Ext,
+		expires:  expires,
+	}
+	h.sessions.Store(info.Ext, session)
+	log.Info("mx session started", "ext", info.Ext)
+	go h.sessionWatch(session)
+	return info, nil
+}
+
+// sessionWatch поддерживает пользовательское соединение, закрывает его после
+// окончания срока действия сессии и удаляет сессию из списка при разрыве
+// соединения.
+func (h *HTTPHandler) sessionWatch(session *UserSession) {
+	var ticker = time.NewTicker(sessionKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.mu.RLock()
+			var expired = time.Now().After(session.expires)
+			h.mu.RUnlock()
+			if expired {
+				log.Info("mx session expired", "ext", session.Ext)
+				session.conn.Logout()
+				session.conn.Close()
+				continue
+			}
+			if err := session.conn.Send("<keepalive/>"); err != nil {
+				log.Error("mx session keepalive error", err, "ext", session.Ext)
+			}
+		case err := <-session.conn.Done():
+			if data, ok := h.sessions.Load(session.Ext); ok && data == session {
+				h.sessions.Delete(session.Ext)
+			}
+			log.Info("mx session closed", "ext", session.Ext, err)
+			return
+		}
+	}
+}
+
+// sessionStop закрывает пользовательское соединение с сервером MX.
+func (h *HTTPHandler) sessionStop(ext string) error {
+	data, ok := h.sessions.Load(ext)
+	if !ok {
+		return nil
+	}
+	h.sessions.Delete(ext)
+	var session = data.(*UserSession)
+	session.conn.Logout()
+	return session.conn.Close()
+}
+
+// commands возвращает соединение с сервером MX, через которое нужно
+// отправлять команды пользователя. В режиме пользовательских сессий это
+// соединение самого пользователя, в противном случае — общее серверное.
+// Команды, авторизованные ключом API, всегда отправляются через серверное
+// соединение.
+func (h *HTTPHandler) commands(token *TokenInfo) (*MXServer, error) {
+	if token.Ext == "" {
+		return nil, rest.NewError(http.StatusBadRequest, "extension required")
+	}
+	if !h.userSessionsEnabled() || token.Key != nil {
+		return h.mx(), nil
+	}
+	if data, ok := h.sessions.Load(token.Ext); ok {
+		return data.(*UserSession).MXServer, nil
+	}
+	return nil, rest.NewError(http.StatusUnauthorized, "mx session closed")
+}
+
+// userSessionsEnabled возвращает true, если включен режим пользовательских
+// сессий.
+func (h *HTTPHandler) userSessionsEnabled() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.userSessions
+}
+
+// setUserSessions включает или выключает режим пользовательских сессий без
+// переподключения к серверу MX. При выключении открытые соединения
+// пользователей закрываются.
+func (h *HTTPHandler) setUserSessions(enabled bool) {
+	h.mu.Lock()
+	h.userSessions = enabled
+	h.mu.Unlock()
+	if enabled {
+		return
+	}
+	h.sessions.Range(func(ext, _ interface{}) bool {
+		h.sessionStop(ext.(string))
+		return true
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// adminSetupTemplate используется для отображения страницы первоначальной
+// настройки сервиса.
+var adminSetupTemplate = template.Must(template.New("").Parse(`<html>
+<title>{{.Version}} setup</title>
+<form method="POST" action="/setup">
+<fieldset><legend>Setup token</legend>
+<input name="token" value="{{.Token}}" placeholder="token from the service log" autocomplete="off"><br>
+</fieldset>
+<fieldset><legend>Admin</legend>
+<input name="login" value="{{.Login}}" placeholder="admin login"><br>
+<input name="password" type="password" placeholder="admin password"><br>
+<input name="password2" type="password" placeholder="repeat password"><br>
+</fieldset>
+<fieldset><legend>MX</legend>
+<input name="mx.host" value="{{.MXHost}}" placeholder="mx host"><br>
+<input name="mx.login" value="{{.MXLogin}}" placeholder="mx server login"><br>
+<input name="mx.password" type="password" placeholder="mx password"><br>
+<button name="action" value="test">Test connection</button>
+</fieldset>
+<fieldset><legend>Server</legend>
+<input name="server.host" value="{{.ServerHost}}" placeholder="server host"><br>
+</fieldset>
+{{if .Message}}<div>{{.Message}}</div>{{end}}
+<button name="action" value="save">Save</button>
+</form>
+</html>`))
+
+// setupForm описывает данные формы первоначальной настройки.
+type setupForm struct {
+	Version    string
+	Token      string
+	Login      string
+	MXHost     string
+	MXLogin    string
+	MXPassword string // не отображается на странице
+	ServerHost string
+	Message    string // результат проверки или описание ошибки
+}
+
+// setupPage отдает страницу первоначальной настройки.
+func (a *Admin) setupPage(w http.ResponseWriter, status int, form *setupForm) {
+	form.Version = agent
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := adminSetupTemplate.Execute(w, form); err != nil {
+		a.log.Error("http response error", err)
+	}
+}
+
+// Setup отвечает за первоначальную настройку сервиса: создание учетной
+// записи администратора, параметры подключения к серверу MX с проверкой
+// соединения и адрес публичного сервера. Для защиты от постороннего
+// вмешательства требуется одноразовый токен, который выводится в лог при
+// запуске сервиса.
+func (a *Admin) Setup(w http.ResponseWriter, r *http.Request) {
+	a.config.mu.RLock()
+	var form = &setupForm{
+		MXHost:     a.config.MX.Host,
+		MXLogin:    a.config.MX.Login,
+		ServerHost: a.config.Server.Host,
+	}
+	a.config.mu.RUnlock()
+	switch r.Method {
+	case "GET":
+		a.setupPage(w, http.StatusOK, form)
+		return
+	case "POST":
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		status := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var (
+		password  = r.PostForm.Get("password")
+		password2 = r.PostForm.Get("password2")
+		keys      = []string{"ip:" + remoteIP(r)}
+	)
+	form.Token = strings.TrimSpace(r.PostForm.Get("token"))
+	form.Login = strings.TrimSpace(r.PostForm.Get("login"))
+	form.MXHost = strings.TrimSpace(r.PostForm.Get("mx.host"))
+	form.MXLogin = strings.TrimSpace(r.PostForm.Get("mx.login"))
+	form.MXPassword = r.PostForm.Get("mx.password")
+	form.ServerHost = strings.TrimSpace(r.PostForm.Get("server.host"))
+	// переопределенные значения изменить нельзя
+	a.config.mu.RLock()
+	for name, value := range map[string]*string{
+		"mx.host":     &form.MXHost,
+		"mx.login":    &form.MXLogin,
+		"mx.password": &form.MXPassword,
+		"server.host": &form.ServerHost,
+	} {
+		if a.config.Overridden(name) {
+			*value = a.config.field(name)
+		}
+	}
+	a.config.mu.RUnlock()
+	// проверяем токен с ограничением количества неудачных попыток
+	if locked := a.limiter.Locked(keys...); locked > 0 {
+		form.Message = "Too many failed attempts. Try again later."
+		a.setupPage(w, http.StatusTooManyRequests, form)
+		return
+	}
+	a.mu.RLock()
+	var token = a.setupToken
+	a.mu.RUnlock()
+	if token == "" ||
+		subtle.ConstantTimeCompare([]byte(form.Token), []byte(token)) != 1 {
+		if locked := a.limiter.Failed(keys...); locked > 0 {
+			securityLog.Warn("repeated setup token failures",
+				"ip", remoteIP(r), "lockout", locked.String())
+		}
+		form.Message = "Bad setup token."
+		a.setupPage(w, http.StatusForbidden, form)
+		a.log.Error("bad setup token", "ip", remoteIP(r))
+		return
+	}
+	a.limiter.Succeeded(keys...)
+	if form.MXHost == "" || form.MXLogin == "" || form.MXPassword == "" {
+		form.Message = "MX host, login and password required."
+		a.setupPage(w, http.StatusBadRequest, form)
+		return
+	}
+	if err := checkField("mx.host", form.MXHost); err != nil {
+		form.Message = err.Error()
+		a.setupPage(w, http.StatusBadRequest, form)
+		return
+	}
+	// проверяем подключение к серверу MX
+	if err := CheckMXServer(form.MXHost, form.MXLogin, form.MXPassword); err != nil {
+		form.Message = "MX connection error: " + err.Error()
+		a.setupPage(w, http.StatusBadRequest, form)
+		a.log.Error("setup mx connection error", err)
+		return
+	}
+	if r.PostForm.Get("action") == "test" {
+		form.Message = "MX connection OK."
+		a.setupPage(w, http.StatusOK, form)
+		return
+	}
+	switch {
+	case form.Login == "" || password == "":
+		form.Message = "Admin login and password required."
+	case password != password2:
+		form.Message = "Passwords do not match."
+	case form.ServerHost == "":
+		form.Message = "Server host required."
+	default:
+		if err := checkField("server.host", form.ServerHost); err != nil {
+			form.Message = err.Error()
+		}
+	}
+	if form.Message != "" {
+		a.setupPage(w, http.StatusBadRequest, form)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		a.log.Error("bcrypt password error", err)
+		return
+	}
+	a.config.mu.Lock()
+	if len(a.config.Admins) > 0 { // настройка уже выполнена
+		a.config.mu.Unlock()
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	var oldMXHost, oldMXLogin, oldServerHost = a.config.MX.Host,
+		a.config.MX.Login, a.config.Server.Host
+	a.config.Admins = []*AdminAccount{{Login: form.Login, Password: hash}}
+	a.config.MX.Host = form.MXHost
+	a.config.MX.Login = form.MXLogin
+	a.config.MX.Password = []byte(form.MXPassword)
+	a.config.Server.Host = form.ServerHost
+	a.config.mu.Unlock()
+	if err := a.config.Save(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		a.log.Error("config save error", err)
+		return
+	}
+	session, err := a.startSession(w, r, form.Login)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		a.log.Error("admin session error", err)
+		return
+	}
+	r = withAdminSession(r, session)
+	a.audit(r, "admins", "", form.Login)
+	a.audit(r, "mx.host", oldMXHost, form.MXHost)
+	a.audit(r, "mx.login", oldMXLogin, form.MXLogin)
+	a.audit(r, "mx.password", secretMask, secretMask)
+	a.audit(r, "server.host", oldServerHost, form.ServerHost)
+	securityLog.Info("first-run setup completed", "login", form.Login,
+		"ip", remoteIP(r))
+	// запускаем прокси с новыми настройками
+	a.mu.Lock()
+	a.setupToken = "" // токен больше не действителен
+	if a.proxy != nil {
+		a.proxy.Close()
+	}
+	proxy, err := NewProxy(a.config)
+	a.config.mu.Lock()
+	a.proxy, a.config.err = proxy, err
+	a.config.mu.Unlock()
+	a.mu.Unlock()
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+	"github.com/mdigger/sse"
+)
+
+// Group описывает группу пользователей сервера MX.
+type Group struct {
+	ID      string   `xml:"groupId,attr" json:"id"`
+	Name    string   `xml:"name,attr" json:"name"`
+	Members []string `xml:"member>ext" json:"members"`
+}
+
+// Groups возвращает список групп пользователей сервера MX.
+func (m *MXServer) Groups() ([]*Group, error) {
+	resp, err := m.conn.SendWithResponse("<GroupGetList/>")
+	if err != nil {
+		return nil, err
+	}
+	var list = new(struct {
+		Groups []*Group `xml:"group"`
+	})
+	if err = resp.Decode(list); err != nil {
+		return nil, err
+	}
+	return list.Groups, nil
+}
+
+// groupsCacheTTL задает время, в течение которого используется сохраненный
+// список групп пользователей сервера MX.
+var groupsCacheTTL = time.Minute
+
+// cachedGroups возвращает список групп пользователей сервера MX, сохраняя
+// его на время groupsCacheTTL. Если получить список с сервера не удалось,
+// то возвращается ранее сохраненный список.
+func (m *MXServer) cachedGroups() ([]*Group, error) {
+	m.mu.RLock()
+	var groups, loaded = m.groups, m.groupsAt
+	m.mu.RUnlock()
+	if groups != nil && time.Since(loaded) < groupsCacheTTL {
+		return groups, nil
+	}
+	list, err := m.Groups()
+	if err != nil {
+		if groups != nil {
+			return groups, nil
+		}
+		return nil, err
+	}
+	if list == nil {
+		list = []*Group{}
+	}
+	m.mu.Lock()
+	m.groups, m.groupsAt = list, time.Now()
+	m.mu.Unlock()
+	return list, nil
+}
+
+// GroupMembers возвращает список внутренних номеров пользователей группы MX
+// с указанным названием.
+func (m *MXServer) GroupMembers(name string) ([]string, error) {
+	groups, err := m.Groups()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if group.Name == name {
+			return group.Members, nil
+		}
+	}
+	return nil, rest.NewError(http.StatusNotFound, "group not found")
+}
+
+// supervisorEvents отдает в одном потоке SSE события нескольких
+// пользователей. Для каждого из них при необходимости запускается монитор.
+// В каждое событие добавляется внутренний номер пользователя, к которому оно
+// относится.
+func (h *HTTPHandler) supervisorEvents(c *rest.Context, token *TokenInfo) error {
+	if !token.Allowed(scopeSupervise) {
+		return c.Error(http.StatusForbidden, "supervisor role required")
+	}
+	var mxs = h.mx()
+	var exts = splitList(c.Form("ext"))
+	if group := c.Form("group"); group != "" {
+		c.AddLogField("group", group)
+		members, err := mxs.GroupMembers(group)
+		if err != nil {
+			return err
+		}
+		for _, ext := range members {
+			if token.allowedExt(ext) != nil {
+				continue // пропускаем номера, не разрешенные для ключа
+			}
+			exts = append(exts, ext)
+		}
+	}
+	if len(exts) == 0 {
+		return c.Error(http.StatusBadRequest, "extensions required")
+	}
+	var broker = new(sse.Server)
+	defer broker.Close()
+	for _, ext := range exts {
+		md, err := mxs.monitorAcquire(ext)
+		if err != nil {
+			return err
+		}
+		md.watchers.Store(broker, struct{}{})
+		defer h.monitorRelease(md)
+		defer md.watchers.Delete(broker)
+	}
+	var log = log.New("sse")
+	log.Debug("supervisor connected", "exts", strings.Join(exts, ","))
+	// запускаем отдачу событий
+	broker.ServeHTTP(c.Response, c.Request)
+	log.Debug("supervisor disconnected", "exts", strings.Join(exts, ","))
+	return nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"rsc.io/qr"
+)
+
+// параметры двухфакторной авторизации администраторов (RFC 6238)
+const (
+	totpPeriod        = 30 // время действия одного кода в секундах
+	totpSecretSize    = 20 // размер секретного ключа в байтах
+	totpRecoveryCodes = 10 // количество кодов восстановления
+)
+
+// totpEncoding используется для представления секретного ключа в
+// приложениях-аутентификаторах.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode возвращает шестизначный код для указанного секретного ключа и
+// номера интервала времени.
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	var mac = hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	var sum = mac.Sum(nil)
+	var offset = sum[len(sum)-1] & 0x0f
+	var value = binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// totpVerify проверяет код с учетом возможного расхождения часов на один
+// интервал и возвращает номер интервала совпавшего кода. Коды интервалов,
+// не превышающих last, повторно не принимаются.
+func totpVerify(secret []byte, code string, now time.Time, last uint64) (uint64, bool) {
+	var counter = uint64(now.Unix()) / totpPeriod
+	for _, c := range []uint64{counter - 1, counter, counter + 1} {
+		if c > last && hmac.Equal([]byte(totpCode(secret, c)), []byte(code)) {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI возвращает адрес для добавления ключа в приложение-аутентификатор.
+func totpURI(login string, secret []byte) string {
+	return "otpauth://totp/" + url.PathEscape(appName+":"+login) + "?" +
+		url.Values{
+			"secret": {totpEncoding.EncodeToString(secret)},
+			"issuer": {appName},
+		}.Encode()
+}
+
+// normalizeRecoveryCode приводит код восстановления к единому виду, убирая
+// разделители и пробелы.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes возвращает новые коды восстановления и их bcrypt-хеши.
+func newRecoveryCodes() (codes []string, hashes [][]byte, err error) {
+	for i := 0; i < totpRecoveryCodes; i++ {
+		var data = make([]byte, 5)
+		if _, err := rand.Read(data); err != nil {
+			return nil, nil, err
+		}
+		var code = hex.EncodeToString(data)
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hash)
+	}
+	return codes, hashes, nil
+}
+
+// verifyCode проверяет одноразовый код или код восстановления администратора
+// с подключенной двухфакторной авторизацией. Использованный код
+// восстановления удаляется, о чем сообщает флаг recovery: в этом случае
+// конфигурацию необходимо сохранить. Коды восстановления сравниваются с
+// хешами без блокировки конфигурации, поэтому функция должна вызываться без
+// нее.
+func (c *Config) verifyCode(login, code string) (ok, recovery bool) {
+	code = strings.TrimSpace(code)
+	if len(code) == 6 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		var account = c.admin(login)
+		if account == nil || account.TOTP == nil {
+			return false, false
+		}
+		counter, ok := totpVerify(account.TOTP, code, time.Now(), account.totpUsed)
+		if ok {
+			account.totpUsed = counter
+		}
+		return ok, false
+	}
+	code = normalizeRecoveryCode(code)
+	if code == "" {
+		return false, false
+	}
+	c.mu.RLock()
+	var hashes [][]byte
+	if account := c.admin(login); account != nil && account.TOTP != nil {
+		hashes = append(hashes, account.Recovery...)
+	}
+	c.mu.RUnlock()
+	var used []byte
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword(hash, []byte(code)) == nil {
+			used = hash
+			break
+		}
+	}
+	if used == nil {
+		return false, false
+	}
+	// удаляем код, если он не был использован параллельным запросом
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if account := c.admin(login); account != nil {
+		for i, hash := range account.Recovery {
+			if bytes.Equal(hash, used) {
+				account.Recovery = append(account.Recovery[:i:i],
+					account.Recovery[i+1:]...)
+				return true, true
+			}
+		}
+	}
+	return false, false
+}
+
+// totpSetupTemplate используется для отображения QR-кода при подключении
+// двухфакторной авторизации.
+var totpSetupTemplate = template.Must(template.New("").Parse(`<html>
+<title>Two-factor authentication</title>
+<p>Scan the QR code with an authenticator app or enter the key manually.</p>
+<img src="data:image/png;base64,{{.QR}}" alt="QR code"><br>
+<code>{{.Secret}}</code>
+<form method="POST" action="/totp">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input name="code" placeholder="code from the app" autocomplete="off" autofocus>
+<button name="action" value="enable">Enable</button>
+</form>
+<a href="/">Back</a>
+</html>`))
+
+// totpRecoveryTemplate используется для однократного отображения кодов
+// восстановления.
+var totpRecoveryTemplate = template.Must(template.New("").Parse(`<html>
+<title>Recovery codes</title>
+<p>Two-factor authentication enabled. Save the recovery codes now: they will
+not be shown again. Each code can be used once instead of the app code.</p>
+<pre>{{range .}}{{.}}
+{{end}}</pre>
+<a href="/">Back</a>
+</html>`))
+
+// TOTP отвечает за подключение и отключение двухфакторной авторизации для
+// учетной записи текущего администратора.
+func (a *Admin) TOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		status := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var session = adminSessionFrom(r)
+	if session == nil {
+		status := http.StatusUnauthorized
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	var login = session.Login
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.PostForm.Get("action") {
+	case "setup": // генерируем новый ключ и отображаем QR-код
+		var secret = make([]byte, totpSecretSize)
+		if _, err := rand.Read(secret); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			a.log.Error("totp secret error", err)
+			return
+		}
+		code, err := qr.Encode(totpURI(login, secret), qr.M)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			a.log.Error("qr code error", err)
+			return
+		}
+		a.sessions.mu.Lock()
+		session.totp = secret // ключ сохраняется после подтверждения кодом
+		a.sessions.mu.Unlock()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := totpSetupTemplate.Execute(w, map[string]string{
+			"QR":     base64.StdEncoding.EncodeToString(code.PNG()),
+			"Secret": totpEncoding.EncodeToString(secret),
+			"CSRF":   session.CSRF,
+		}); err != nil {
+			a.log.Error("http response error", err)
+		}
+		return
+	case "enable": // проверяем код и сохраняем ключ
+		a.sessions.mu.Lock()
+		var secret = session.totp
+		a.sessions.mu.Unlock()
+		if secret == nil {
+			http.Error(w, "totp setup required", http.StatusBadRequest)
+			return
+		}
+		counter, ok := totpVerify(secret,
+			strings.TrimSpace(r.PostForm.Get("code")), time.Now(), 0)
+		if !ok {
+			http.Error(w, "bad verification code", http.StatusBadRequest)
+			return
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			a.log.Error("recovery codes error", err)
+			return
+		}
+		a.config.mu.Lock()
+		var account = a.config.admin(login)
+		if account != nil {
+			account.TOTP, account.Recovery = secret, hashes
+			account.totpUsed = counter
+		}
+		a.config.mu.Unlock()
+		if account == nil {
+			http.Error(w, "admin not found", http.StatusNotFound)
+			return
+		}
+		a.sessions.mu.Lock()
+		session.totp = nil
+		a.sessions.mu.Unlock()
+		if err := a.config.Save(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			a.log.Error("config save error", err)
+			return
+		}
+		a.audit(r, "admins."+login+".totp", "false", "true")
+		securityLog.Info("admin two-factor enabled", "login", login)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := totpRecoveryTemplate.Execute(w, codes); err != nil {
+			a.log.Error("http response error", err)
+		}
+		return
+	case "disable": // отключение требует подтверждения кодом
+		var ok, _ = a.config.verifyCode(login, r.PostForm.Get("code"))
+		if ok {
+			a.config.mu.Lock()
+			if account := a.config.admin(login); account != nil {
+				account.TOTP, account.Recovery = nil, nil
+			}
+			a.config.mu.Unlock()
+		}
+		if !ok {
+			http.Error(w, "bad verification code", http.StatusBadRequest)
+			return
+		}
+		if err := a.config.Save(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			a.log.Error("config save error", err)
+			return
+		}
+		a.audit(r, "admins."+login+".totp", "true", "false")
+		securityLog.Warn("admin two-factor disabled", "login", login)
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// секретный ключ из тестовых векторов RFC 6238 для HMAC-SHA1
+var totpTestSecret = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// коды из приложения B RFC 6238, сокращенные до шести цифр
+	var tests = []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		var counter = uint64(test.unix) / totpPeriod
+		if code := totpCode(totpTestSecret, counter); code != test.code {
+			t.Errorf("totpCode(%d) = %q, want %q", test.unix, code, test.code)
+		}
+	}
+}
+
+func TestTOTPVerify(t *testing.T) {
+	var now = time.Unix(1234567890, 0)
+	var counter = uint64(now.Unix()) / totpPeriod
+	var code = func(c uint64) string { return totpCode(totpTestSecret, c) }
+	var tests = []struct {
+		name    string
+		code    string
+		last    uint64
+		ok      bool
+		matched uint64
+	}{
+		{"current", code(counter), 0, true, counter},
+		{"previous", code(counter - 1), 0, true, counter - 1},
+		{"next", code(counter + 1), 0, true, counter + 1},
+		{"too old", code(counter - 2), 0, false, 0},
+		{"too new", code(counter + 2), 0, false, 0},
+		{"wrong", "000000", 0, false, 0},
+		{"empty", "", 0, false, 0},
+		{"replayed", code(counter), counter, false, 0},
+		{"after previous", code(counter), counter - 1, true, counter},
+		{"older than used", code(counter - 1), counter, false, 0},
+	}
+	for _, test := range tests {
+		matched, ok := totpVerify(totpTestSecret, test.code, now, test.last)
+		if ok != test.ok || matched != test.matched {
+			t.Errorf("%s: totpVerify() = %d, %v, want %d, %v", test.name,
+				matched, ok, test.matched, test.ok)
+		}
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	var tests = []struct {
+		code, want string
+	}{
+		{"abcde-12345", "abcde12345"},
+		{"ABCDE-12345", "abcde12345"},
+		{"abcde 12345", "abcde12345"},
+		{"abcde12345", "abcde12345"},
+		{" - ", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := normalizeRecoveryCode(test.code); got != test.want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", test.code,
+				got, test.want)
+		}
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != totpRecoveryCodes || len(hashes) != totpRecoveryCodes {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes),
+			len(hashes), totpRecoveryCodes)
+	}
+	for i, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("bad recovery code format %q", code)
+		}
+		if bcrypt.CompareHashAndPassword(hashes[i],
+			[]byte(normalizeRecoveryCode(code))) != nil {
+			t.Errorf("hash does not match recovery code %q", code)
+		}
+	}
+}
+
+func TestConfigVerifyCode(t *testing.T) {
+	var recovery = []string{"aaaaa-11111", "bbbbb-22222"}
+	var hashes [][]byte
+	for _, code := range recovery {
+		hash, err := bcrypt.GenerateFromPassword(
+			[]byte(normalizeRecoveryCode(code)), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	var config = &Config{Admins: []*AdminAccount{
+		{Login: "admin", TOTP: Secret(totpTestSecret), Recovery: hashes},
+		{Login: "plain"},
+	}}
+	var code = totpCode(totpTestSecret, uint64(time.Now().Unix())/totpPeriod)
+	// проверки выполняются по порядку: использованные коды повторно не
+	// принимаются
+	var tests = []struct {
+		name     string
+		login    string
+		code     string
+		ok       bool
+		recovery bool
+		left     int // оставшихся кодов восстановления
+	}{
+		{"totp code", "admin", code, true, false, 2},
+		{"replayed totp code", "admin", code, false, false, 2},
+		{"wrong recovery code", "admin", "ccccc-33333", false, false, 2},
+		{"recovery code", "admin", "AAAAA-11111", true, true, 1},
+		{"reused recovery code", "admin", "aaaaa11111", false, false, 1},
+		{"second recovery code", "admin", " bbbbb 22222 ", true, true, 0},
+		{"empty code", "admin", "", false, false, 0},
+		{"unknown login", "nobody", code, false, false, 0},
+		{"no totp", "plain", code, false, false, 0},
+	}
+	for _, test := range tests {
+		ok, recovery := config.verifyCode(test.login, test.code)
+		if ok != test.ok || recovery != test.recovery {
+			t.Errorf("%s: verifyCode() = %v, %v, want %v, %v", test.name,
+				ok, recovery, test.ok, test.recovery)
+		}
+		if left := len(config.admin("admin").Recovery); left != test.left {
+			t.Errorf("%s: %d recovery codes left, want %d", test.name, left,
+				test.left)
+		}
+	}
+}
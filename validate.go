@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// checkHost проверяет синтаксис адреса сервера в виде имени хоста или
+// IP-адреса с необязательным портом. Если hostRequired не установлен, то
+// имя хоста может быть опущено при указании порта.
+func checkHost(name, value string, hostRequired bool) error {
+	host, port, err := net.SplitHostPort(value)
+	if err, ok := err.(*net.AddrError); ok && err.Err == "missing port in address" {
+		host, port = value, ""
+	} else if err != nil {
+		return errors.New("bad " + name + ": " + err.Error())
+	}
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return errors.New("bad " + name + " port: " + port)
+		}
+	}
+	if host == "" {
+		if hostRequired || port == "" {
+			return errors.New(name + " is empty")
+		}
+		return nil
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	// имя хоста состоит из меток, разделенных точками
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 ||
+			strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return errors.New("bad " + name + ": " + host)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+				r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return errors.New("bad " + name + ": " + host)
+			}
+		}
+	}
+	return nil
+}
+
+// listenAddr возвращает адрес, на котором запускается HTTP сервер для
+// указанного адреса сервиса.
+func listenAddr(serverURL string) string {
+	if strings.HasPrefix(serverURL, "https://") {
+		return ":https"
+	}
+	if hostURL, err := url.Parse(serverURL); err == nil {
+		if port := hostURL.Port(); port != "" {
+			return ":" + port
+		}
+	}
+	return ":http"
+}
+
+// listenPort возвращает номер порта адреса HTTP сервера, заменяя название
+// службы (http, https) номером.
+func listenPort(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if n, err := net.LookupPort("tcp", port); err == nil {
+		return strconv.Itoa(n)
+	}
+	return port
+}
+
+// sameListenAddr возвращает true, если адреса HTTP сервера совпадают с
+// учетом названий служб: ":443" и ":https" считаются одним адресом.
+func sameListenAddr(addr1, addr2 string) bool {
+	return listenPort(addr1) == listenPort(addr2)
+}
+
+// clone возвращает копию конфигурации для проверки изменений перед их
+// применением. Должна вызываться с блокировкой конфигурации.
+func (c *Config) clone() *Config {
+	return &Config{
+		Admins:      c.Admins,
+		Server:      c.Server,
+		MX:          c.MX,
+		Roles:       c.Roles,
+		APIKeys:     c.APIKeys,
+		Params:      copyParams(c.Params),
+		GroupParams: copyScopes(c.GroupParams),
+		ExtParams:   copyScopes(c.ExtParams),
+		filename:    c.filename,
+		overrides:   c.overrides,
+		fileValues:  c.fileValues,
+		modified:    c.modified,
+		err:         c.err,
+	}
+}
+
+// checkConnection проверяет новые параметры подключения до их применения:
+// авторизуется на сервере MX с новыми логином и паролем и пробует занять
+// новый адрес публичного сервера. Проверяются только изменившиеся
+// параметры.
+func (a *Admin) checkConnection(old, next configState) error {
+	if next.mxHost != old.mxHost || next.mxLogin != old.mxLogin ||
+		next.mxPassword != old.mxPassword {
+		err := CheckMXServer(next.mxHost, next.mxLogin, next.mxPassword)
+		if err != nil {
+			return errors.New("mx connection error: " + err.Error())
+		}
+	}
+	if next.serverHost == old.serverHost {
+		return nil
+	}
+	var addr = listenAddr(hostURL(next.serverHost))
+	// адрес уже занят запущенным сервером
+	a.mu.RLock()
+	var running = a.proxy != nil && sameListenAddr(a.proxy.Addr(), addr)
+	a.mu.RUnlock()
+	if running {
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.New("server listen error: " + err.Error())
+	}
+	return ln.Close()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCheckHost(t *testing.T) {
+	var tests = []struct {
+		value        string
+		hostRequired bool
+		ok           bool
+	}{
+		{"localhost:8080", false, true},
+		{"localhost", false, true},
+		{":8080", false, true},
+		{":8080", true, false},
+		{"", false, false},
+		{"", true, false},
+		{"mx.example.com", true, true},
+		{"mx.example.com.", true, true},
+		{"mx.example.com:7778", true, true},
+		{"mx_1.example.com", true, true},
+		{"192.168.0.1:7778", true, true},
+		{"[::1]:7778", true, true},
+		{"::1", true, false},
+		{"mx.example.com:0", true, false},
+		{"mx.example.com:65536", true, false},
+		{"mx.example.com:http", true, false},
+		{"mx..example.com", true, false},
+		{"-mx.example.com", true, false},
+		{"mx-.example.com", true, false},
+		{"mx example.com", true, false},
+		{"mx.example.com/path", true, false},
+		{"http://mx.example.com", true, false},
+		{"a:b:c", false, false},
+	}
+	for _, test := range tests {
+		var err = checkHost("host", test.value, test.hostRequired)
+		if (err == nil) != test.ok {
+			t.Errorf("checkHost(%q, %v) = %v, want ok %v", test.value,
+				test.hostRequired, err, test.ok)
+		}
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	var tests = []struct {
+		url, addr string
+	}{
+		{"https://mx.example.com", ":https"},
+		{"https://mx.example.com:8443", ":https"},
+		{"http://localhost:8080", ":8080"},
+		{"http://localhost", ":http"},
+		{"http://[::1]:8080", ":8080"},
+		{"localhost:8080", ":http"},
+	}
+	for _, test := range tests {
+		if addr := listenAddr(test.url); addr != test.addr {
+			t.Errorf("listenAddr(%q) = %q, want %q", test.url, addr, test.addr)
+		}
+	}
+}
+
+func TestSameListenAddr(t *testing.T) {
+	var tests = []struct {
+		addr1, addr2 string
+		same         bool
+	}{
+		{":443", ":https", true},
+		{":https", ":https", true},
+		{":80", ":http", true},
+		{":8080", ":8080", true},
+		{":8080", ":8081", false},
+		{":443", ":http", false},
+		{":http", ":https", false},
+	}
+	for _, test := range tests {
+		if same := sameListenAddr(test.addr1, test.addr2); same != test.same {
+			t.Errorf("sameListenAddr(%q, %q) = %v, want %v", test.addr1,
+				test.addr2, same, test.same)
+		}
+	}
+}
+
+func TestConfigClone(t *testing.T) {
+	var config = &Config{
+		Params: map[string]json.RawMessage{"phoneCountry": json.RawMessage(`"EE"`)},
+		GroupParams: map[string]map[string]json.RawMessage{
+			"Riga": {"phoneCountry": json.RawMessage(`"LV"`)},
+		},
+		ExtParams: map[string]map[string]json.RawMessage{
+			"3095": {"maxCalls": json.RawMessage(`5`)},
+		},
+		filename: "mxflex.json",
+	}
+	config.Server.Host = "localhost:8080"
+	var clone = config.clone()
+	// изменения параметров копии не должны затрагивать исходную
+	// конфигурацию
+	var changes = []struct {
+		name   string
+		change func(*Config)
+		check  func(*Config) bool
+	}{
+		{
+			"server host",
+			func(c *Config) { c.Server.Host = "localhost:9090" },
+			func(c *Config) bool { return c.Server.Host == "localhost:8080" },
+		},
+		{
+			"global param",
+			func(c *Config) { c.Params["phoneCountry"] = json.RawMessage(`"RU"`) },
+			func(c *Config) bool { return string(c.Params["phoneCountry"]) == `"EE"` },
+		},
+		{
+			"new global param",
+			func(c *Config) { c.Params["new"] = json.RawMessage(`1`) },
+			func(c *Config) bool { _, ok := c.Params["new"]; return !ok },
+		},
+		{
+			"group param",
+			func(c *Config) { c.GroupParams["Riga"]["phoneCountry"] = json.RawMessage(`"RU"`) },
+			func(c *Config) bool {
+				return string(c.GroupParams["Riga"]["phoneCountry"]) == `"LV"`
+			},
+		},
+		{
+			"deleted ext params",
+			func(c *Config) { delete(c.ExtParams, "3095") },
+			func(c *Config) bool { return len(c.ExtParams["3095"]) == 1 },
+		},
+	}
+	for _, test := range changes {
+		test.change(clone)
+		if !test.check(config) {
+			t.Errorf("%s: change of clone affected the config", test.name)
+		}
+	}
+	if clone.filename != config.filename {
+		t.Errorf("clone filename %q, want %q", clone.filename, config.filename)
+	}
+}
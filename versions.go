@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// configBackups задает количество сохраняемых предыдущих версий
+// конфигурационного файла.
+var configBackups = 10
+
+// configVersionFormat задает формат времени в именах файлов с предыдущими
+// версиями конфигурации.
+const configVersionFormat = "20060102-150405.000000"
+
+// ConfigVersion описывает сохраненную предыдущую версию конфигурации.
+type ConfigVersion struct {
+	Name string    // имя версии
+	Time time.Time // время сохранения
+	Size int64     // размер файла
+}
+
+// writeConfigFile атомарно записывает данные в конфигурационный файл.
+// Предыдущее содержимое файла сохраняется как резервная копия.
+func writeConfigFile(filename string, data []byte) error {
+	if err := backupConfigFile(filename); err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, data)
+}
+
+// writeFileAtomic атомарно записывает данные в файл, доступный только для
+// владельца: данные записываются во временный файл, который затем
+// переименовывается.
+func writeFileAtomic(filename string, data []byte) error {
+	var dir, name = filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := ioutil.TempFile(dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// backupConfigFile сохраняет копию текущего конфигурационного файла и
+// удаляет самые старые копии сверх допустимого количества.
+func backupConfigFile(filename string) error {
+	if configBackups <= 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var backup = filename + "." + time.Now().Format(configVersionFormat)
+	if err = ioutil.WriteFile(backup, data, 0600); err != nil {
+		return err
+	}
+	versions, err := configVersions(filename)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions[min(len(versions), configBackups):] {
+		os.Remove(filename + "." + version.Name)
+	}
+	return nil
+}
+
+// min возвращает наименьшее из двух чисел.
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// configVersions возвращает список сохраненных версий конфигурационного
+// файла, начиная с самой новой.
+func configVersions(filename string) ([]*ConfigVersion, error) {
+	files, err := filepath.Glob(filename + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var versions = make([]*ConfigVersion, 0, len(files))
+	for _, name := range files {
+		name = strings.TrimPrefix(name, filename+".")
+		created, err := time.ParseInLocation(configVersionFormat, name, time.Local)
+		if err != nil {
+			continue // временный или посторонний файл
+		}
+		fi, err := os.Stat(filename + "." + name)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, &ConfigVersion{
+			Name: name,
+			Time: created,
+			Size: fi.Size(),
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Name > versions[j].Name
+	})
+	return versions, nil
+}
+
+// encryptConfigVersions перезаписывает сохраненные версии конфигурационного
+// файла, шифруя их секреты текущим ключом, чтобы после шифрования
+// конфигурации незашифрованные секреты не оставались в резервных копиях.
+// Версии, которые не удается загрузить, удаляются. Возвращает количество
+// перезаписанных версий.
+func encryptConfigVersions(filename string) (int, error) {
+	versions, err := configVersions(filename)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	for _, version := range versions {
+		var name = filename + "." + version.Name
+		config, err := LoadConfig(name, nil)
+		if err == nil {
+			var data []byte
+			if data, err = config.encode(); err == nil {
+				err = writeFileAtomic(name, data)
+			}
+		}
+		if err != nil {
+			if err := os.Remove(name); err != nil {
+				return count, err
+			}
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Versions возвращает список сохраненных предыдущих версий конфигурации.
+func (c *Config) Versions() ([]*ConfigVersion, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return configVersions(c.filename)
+}
+
+// versionsTemplate используется для отображения списка предыдущих версий
+// конфигурации и их отличий от текущей.
+var versionsTemplate = template.Must(template.New("").Parse(`<html>
+<title>Config versions</title>
+<table>
+<tr><th>Time</th><th>Size</th><th></th></tr>
+{{range .Versions}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Size}}</td><td><a href="/versions?version={{.Name}}">diff</a></td></tr>
+{{end}}</table>
+{{with .Version}}
+<h3>{{.Time.Format "2006-01-02 15:04:05"}}</h3>
+<table>
+<tr><th>Field</th><th>Current</th><th>Version</th></tr>
+{{range $.Changes}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td><td>{{index . 2}}</td></tr>
+{{else}}<tr><td colspan="3">no changes</td></tr>
+{{end}}</table>
+<form method="POST" action="/versions">
+<input type="hidden" name="csrf" value="{{$.CSRF}}">
+<input type="hidden" name="version" value="{{.Name}}">
+<button>Rollback</button>
+</form>
+{{end}}
+<a href="/">Back</a>
+</html>`))
+
+// keepCredentials заменяет учетные записи администраторов и ключи доступа к
+// API восстанавливаемой версии конфигурации текущими, поэтому откат не
+// возвращает удаленные учетные записи, старые пароли, ключи двухфакторной
+// авторизации и отозванные ключи API. Должна вызываться с блокировкой
+// конфигурации.
+func (c *Config) keepCredentials(version *Config) {
+	version.Admins = make([]*AdminAccount, 0, len(c.Admins))
+	for _, account := range c.Admins {
+		var copy = *account
+		version.Admins = append(version.Admins, &copy)
+	}
+	version.APIKeys = append([]*APIKey(nil), c.APIKeys...)
+}
+
+// Versions отдает страницу со списком предыдущих версий конфигурации и
+// отличиями выбранной версии от текущей, а так же восстанавливает выбранную
+// версию.
+func (a *Admin) Versions(w http.ResponseWriter, r *http.Request) {
+	versions, err := a.config.Versions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		a.log.Error("config versions error", err)
+		return
+	}
+	// находим выбранную версию; имя проверяется по списку версий
+	var name = r.FormValue("version")
+	var version *ConfigVersion
+	for _, v := range versions {
+		if v.Name == name {
+			version = v
+			break
+		}
+	}
+	if name != "" && version == nil {
+		http.Error(w, "config version not found", http.StatusNotFound)
+		return
+	}
+	a.config.mu.RLock()
+	var filename, overrides = a.config.filename, a.config.overrides
+	a.config.mu.RUnlock()
+	switch r.Method {
+	case "GET":
+		var changes [][3]string
+		if version != nil {
+			config, err := LoadConfig(filename+"."+version.Name, overrides)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				a.log.Error("config version load error", err)
+				return
+			}
+			a.config.mu.RLock()
+			a.config.keepCredentials(config)
+			changes = a.config.diff(config)
+			a.config.mu.RUnlock()
+		}
+		var csrf string
+		if session := adminSessionFrom(r); session != nil {
+			csrf = session.CSRF
+		}
+		var buf bytes.Buffer
+		if err := versionsTemplate.Execute(&buf, map[string]interface{}{
+			"Versions": versions,
+			"Version":  version,
+			"Changes":  changes,
+			"CSRF":     csrf,
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			a.log.Error("template error", err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err = buf.WriteTo(w); err != nil {
+			a.log.Error("http response error", err)
+		}
+	case "POST": // восстанавливаем выбранную версию
+		if version == nil {
+			http.Error(w, "config version required", http.StatusBadRequest)
+			return
+		}
+		// проверяем, что версия может быть загружена
+		config, err := LoadConfig(filename+"."+version.Name, overrides)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			a.log.Error("config version load error", err)
+			return
+		}
+		// версия сохраняется и применяется с блокировкой текущей
+		// конфигурации, чтобы не потерять параллельные изменения учетных
+		// записей; секреты при сохранении шифруются текущим ключом
+		config.filename = filename
+		a.config.mu.Lock()
+		var state = a.config.state()
+		a.config.keepCredentials(config)
+		if err = config.Save(); err != nil {
+			a.config.mu.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			a.log.Error("config save error", err)
+			return
+		}
+		a.config.update(config)
+		a.config.mu.Unlock()
+		a.audit(r, "config", "", "rollback to "+version.Time.Format("2006-01-02 15:04:05"))
+		a.apply(state)
+		http.Redirect(w, r, "/", http.StatusFound)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		status := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(status), status)
+	}
+}
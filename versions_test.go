@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteConfigFile(t *testing.T) {
+	defer func(backups int) { configBackups = backups }(configBackups)
+	var tests = []struct {
+		backups  int
+		writes   int
+		versions int // количество сохраненных версий
+	}{
+		{0, 3, 0},
+		{2, 1, 0},
+		{2, 2, 1},
+		{2, 4, 2},
+		{10, 3, 2},
+	}
+	for _, test := range tests {
+		configBackups = test.backups
+		var dir = t.TempDir()
+		var filename = filepath.Join(dir, "mxflex.json")
+		for i := 1; i <= test.writes; i++ {
+			if err := writeConfigFile(filename, []byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond) // имена версий должны различаться
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != strconv.Itoa(test.writes) {
+			t.Errorf("backups %d, writes %d: file contains %q", test.backups,
+				test.writes, data)
+		}
+		if fi, err := os.Stat(filename); err != nil {
+			t.Fatal(err)
+		} else if perm := fi.Mode().Perm(); perm != 0600 {
+			t.Errorf("file permissions %v, want 0600", perm)
+		}
+		versions, err := configVersions(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != test.versions {
+			t.Fatalf("backups %d, writes %d: %d versions, want %d",
+				test.backups, test.writes, len(versions), test.versions)
+		}
+		// версии упорядочены от новых к старым и содержат предыдущие данные
+		for i, version := range versions {
+			data, err := ioutil.ReadFile(filename + "." + version.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strconv.Itoa(test.writes - 1 - i); string(data) != want {
+				t.Errorf("backups %d, writes %d: version %d contains %q, want %q",
+					test.backups, test.writes, i, data, want)
+			}
+		}
+		// временные файлы не остаются
+		if files, _ := filepath.Glob(filename + ".tmp*"); len(files) > 0 {
+			t.Errorf("temporary files left: %v", files)
+		}
+	}
+}
+
+func TestConfigVersions(t *testing.T) {
+	var dir = t.TempDir()
+	var filename = filepath.Join(dir, "mxflex.json")
+	// временные и посторонние файлы версиями не считаются
+	var suffixes = []string{
+		".20261018-101500.000001",
+		".20261018-101500.000002",
+		".20261017-235959.999999",
+		".tmp123456",
+		".bak",
+		".20261018",
+		"",
+	}
+	for _, suffix := range suffixes {
+		if err := ioutil.WriteFile(filename+suffix, []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err := configVersions(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = []string{
+		"20261018-101500.000002",
+		"20261018-101500.000001",
+		"20261017-235959.999999",
+	}
+	if len(versions) != len(want) {
+		t.Fatalf("got %d versions, want %d", len(versions), len(want))
+	}
+	for i, version := range versions {
+		if version.Name != want[i] {
+			t.Errorf("version %d = %q, want %q", i, version.Name, want[i])
+		}
+		if version.Size != 2 {
+			t.Errorf("version %q size %d, want 2", version.Name, version.Size)
+		}
+	}
+}
+
+func TestConfigKeepCredentials(t *testing.T) {
+	var current = &Config{
+		Admins: []*AdminAccount{
+			{Login: "admin", Password: []byte("new")},
+		},
+		APIKeys: []*APIKey{{ID: "k2", Name: "current"}},
+	}
+	var version = &Config{
+		Admins: []*AdminAccount{
+			{Login: "admin", Password: []byte("old"), TOTP: Secret("old")},
+			{Login: "deleted", Password: []byte("deleted")},
+		},
+		APIKeys: []*APIKey{{ID: "k1", Name: "revoked"}},
+	}
+	current.keepCredentials(version)
+	var tests = []struct {
+		name string
+		ok   bool
+	}{
+		{"admins count", len(version.Admins) == 1},
+		{"admin password", version.admin("admin") != nil &&
+			string(version.admin("admin").Password) == "new"},
+		{"admin totp", version.admin("admin") != nil &&
+			version.admin("admin").TOTP == nil},
+		{"deleted admin", version.admin("deleted") == nil},
+		{"api keys count", len(version.APIKeys) == 1},
+		{"api key", len(version.APIKeys) == 1 && version.APIKeys[0].ID == "k2"},
+	}
+	for _, test := range tests {
+		if !test.ok {
+			t.Errorf("%s: credentials were not kept", test.name)
+		}
+	}
+	// учетные записи копируются и не изменяют текущую конфигурацию
+	version.Admins[0].Password = []byte("changed")
+	version.APIKeys = append(version.APIKeys[:0], &APIKey{ID: "k3"})
+	if string(current.Admins[0].Password) != "new" || current.APIKeys[0].ID != "k2" {
+		t.Error("change of version credentials affected the current config")
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	var newConfig = func() *Config {
+		var config = &Config{
+			Params: map[string]json.RawMessage{"phoneCountry": json.RawMessage(`"EE"`)},
+			GroupParams: map[string]map[string]json.RawMessage{
+				"Riga": {"phoneCountry": json.RawMessage(`"LV"`)},
+			},
+		}
+		config.Server.Host = "localhost:8080"
+		config.MX.Password = Secret("secret")
+		return config
+	}
+	var tests = []struct {
+		name   string
+		change func(*Config)
+		want   [][3]string
+	}{
+		{"no changes", func(*Config) {}, nil},
+		{"server host", func(c *Config) { c.Server.Host = "localhost:9090" },
+			[][3]string{{"server.host", "localhost:8080", "localhost:9090"}}},
+		{"mx password", func(c *Config) { c.MX.Password = Secret("other") },
+			[][3]string{{"mx.password", secretMask, secretMask}}},
+		{"param value", func(c *Config) { c.Params["phoneCountry"] = json.RawMessage(`"LV"`) },
+			[][3]string{{"params.phoneCountry", "EE", "LV"}}},
+		{"param type", func(c *Config) { c.Params["phoneCountry"] = json.RawMessage(`5`) },
+			[][3]string{{"params.phoneCountry", "EE", "5"}}},
+		{"new param", func(c *Config) { c.Params["maxCalls"] = json.RawMessage(`5`) },
+			[][3]string{{"params.maxCalls", "", "5"}}},
+		{"group param", func(c *Config) { delete(c.GroupParams, "Riga") },
+			[][3]string{{"group:Riga/params.phoneCountry", "LV", ""}}},
+	}
+	for _, test := range tests {
+		var current, next = newConfig(), newConfig()
+		test.change(next)
+		var changes = current.diff(next)
+		if len(changes) != len(test.want) {
+			t.Errorf("%s: diff() = %v, want %v", test.name, changes, test.want)
+			continue
+		}
+		for i := range changes {
+			if changes[i] != test.want[i] {
+				t.Errorf("%s: diff() = %v, want %v", test.name, changes,
+					test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestEncryptConfigVersions(t *testing.T) {
+	defer func(key []byte) { secretKey = key }(secretKey)
+	secretKey = nil
+	var dir = t.TempDir()
+	var filename = filepath.Join(dir, "mxflex.json")
+	var config = new(Config)
+	config.MX.Password = Secret("secret")
+	data, err := config.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// версии, сохраненные до шифрования, и поврежденная версия
+	var versions = []struct {
+		name string
+		data string
+		ok   bool // версия сохраняется
+	}{
+		{"20261018-101500.000001", string(data), true},
+		{"20261018-101500.000002", string(data), true},
+		{"20261018-101500.000003", "{bad", false},
+	}
+	for _, version := range versions {
+		err := ioutil.WriteFile(filename+"."+version.name, []byte(version.data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	secretKey = make([]byte, 32)
+	count, err := encryptConfigVersions(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("%d versions encrypted, want 2", count)
+	}
+	for _, version := range versions {
+		var name = filename + "." + version.name
+		data, err := ioutil.ReadFile(name)
+		if !version.ok {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s: broken version was not removed", version.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), secretPrefix) {
+			t.Errorf("%s: secret is not encrypted: %s", version.name, data)
+		}
+		config, err := LoadConfig(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(config.MX.Password) != "secret" {
+			t.Errorf("%s: password %q after encryption", version.name,
+				config.MX.Password)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mdigger/rest"
+)
+
+// VoiceMail описывает информацию о голосовом сообщении.
+type VoiceMail struct {
+	ID         string    `xml:"mailId,attr" json:"id"`
+	From       string    `xml:"from,attr" json:"from"`
+	FromName   string    `xml:"fromName,attr" json:"fromName,omitempty"`
+	CallerName string    `xml:"callerName,attr" json:"callerName,omitempty"`
+	To         string    `xml:"to,attr" json:"to,omitempty"`
+	Received   int64     `xml:"received,attr" json:"-"`
+	Date       time.Time `xml:"-" json:"received"`
+	Duration   uint32    `xml:"duration,attr" json:"duration"`
+	Read       bool      `xml:"read,attr" json:"read"`
+	Note       string    `xml:"note,attr" json:"note,omitempty"`
+}
+
+// VoiceMailList возвращает список голосовых сообщений из почтового ящика
+// пользователя с указанным внутренним номером.
+func (m *MXServer) VoiceMailList(ext string) ([]*VoiceMail, error) {
+	resp, err := m.conn.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"MailGetListIncoming"`
+		Ext     string   `xml:"ext,attr"`
+	}{
+		Ext: ext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list = new(struct {
+		Mails []*VoiceMail `xml:"mail"`
+	})
+	if err = resp.Decode(list); err != nil {
+		return nil, err
+	}
+	for _, mail := range list.Mails {
+		mail.Date = time.Unix(mail.Received, 0).UTC()
+	}
+	return list.Mails, nil
+}
+
+// VoiceMailFile возвращает содержимое голосового сообщения и его формат.
+func (m *MXServer) VoiceMailFile(ext, id string) (data []byte, format string, err error) {
+	resp, err := m.conn.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"MailReceiveFile"`
+		Ext     string   `xml:"ext,attr"`
+		ID      string   `xml:"mailId,attr"`
+		Format  string   `xml:"format,attr"`
+	}{
+		Ext:    ext,
+		ID:     id,
+		Format: "wav",
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	var file = new(struct {
+		Format string `xml:"format,attr"`
+		Data   string `xml:"data"`
+	})
+	if err = resp.Decode(file); err != nil {
+		return nil, "", err
+	}
+	data, err = base64.StdEncoding.DecodeString(file.Data)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, file.Format, nil
+}
+
+// VoiceMailSetRead помечает голосовое сообщение как прочитанное или
+// непрочитанное.
+func (m *MXServer) VoiceMailSetRead(ext, id string, read bool) error {
+	_, err := m.conn.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"MailSetStatus"`
+		Ext     string   `xml:"ext,attr"`
+		ID      string   `xml:"mailId,attr"`
+		Read    bool     `xml:"read,attr"`
+	}{
+		Ext:  ext,
+		ID:   id,
+		Read: read,
+	})
+	return err
+}
+
+// VoiceMailDelete удаляет голосовое сообщение.
+func (m *MXServer) VoiceMailDelete(ext, id string) error {
+	_, err := m.conn.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"MailDeleteIncoming"`
+		Ext     string   `xml:"ext,attr"`
+		ID      string   `xml:"mailId,attr"`
+	}{
+		Ext: ext,
+		ID:  id,
+	})
+	return err
+}
+
+// voiceMailTypes задает соответствие форматов голосовых сообщений их
+// типам содержимого.
+var voiceMailTypes = map[string]string{
+	"wav": "audio/wav",
+	"mp3": "audio/mpeg",
+	"ogg": "audio/ogg",
+}
+
+// VoiceMails отдает список голосовых сообщений пользователя.
+func (h *HTTPHandler) VoiceMails(c *rest.Context) error {
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
+	if err != nil {
+		return err
+	}
+	mxs, err := h.commands(token)
+	if err != nil {
+		return err
+	}
+	var ext = token.Ext
+	list, err := mxs.VoiceMailList(ext)
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"voicemails": list})
+}
+
+// VoiceMail отдает содержимое голосового сообщения. Поддерживается
+// запрос части файла с помощью заголовка Range.
+func (h *HTTPHandler) VoiceMail(c *rest.Context) error {
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
+	if err != nil {
+		return err
+	}
+	mxs, err := h.commands(token)
+	if err != nil {
+		return err
+	}
+	var ext = token.Ext
+	var id = c.Param("id")
+	c.AddLogField("mailId", id)
+	data, format, err := mxs.VoiceMailFile(ext, id)
+	if err != nil {
+		return err
+	}
+	var contentType = voiceMailTypes[format]
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.SetHeader("Content-Type", contentType)
+	http.ServeContent(c.Response, c.Request, id+"."+format, time.Time{},
+		bytes.NewReader(data))
+	return nil
+}
+
+// VoiceMailRead помечает голосовое сообщение как прочитанное. Если передан
+// параметр read со значением false, то сообщение помечается как
+// непрочитанное.
+func (h *HTTPHandler) VoiceMailRead(c *rest.Context) error {
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
+	if err != nil {
+		return err
+	}
+	mxs, err := h.commands(token)
+	if err != nil {
+		return err
+	}
+	var ext = token.Ext
+	var id = c.Param("id")
+	c.AddLogField("mailId", id)
+	var read = true
+	if value := c.Form("read"); value != "" {
+		if read, err = strconv.ParseBool(value); err != nil {
+			return c.Error(http.StatusBadRequest, "bad read flag")
+		}
+	}
+	return mxs.VoiceMailSetRead(ext, id, read)
+}
+
+// VoiceMailDelete удаляет голосовое сообщение.
+func (h *HTTPHandler) VoiceMailDelete(c *rest.Context) error {
+	token, err := h.tokenInfo(c) // распаковываем и проверяем токен
+	if err != nil {
+		return err
+	}
+	mxs, err := h.commands(token)
+	if err != nil {
+		return err
+	}
+	var ext = token.Ext
+	var id = c.Param("id")
+	c.AddLogField("mailId", id)
+	return mxs.VoiceMailDelete(ext, id)
+}